@@ -0,0 +1,252 @@
+package cloudtasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Snapshot is Faker の in-memory な状態を丸ごと保持する
+//
+// Faker は Queue や Task の実体を保持しておらず、CreateTask の呼び出し履歴と Mock Response の登録内容が状態の全てになる
+// Snapshot が保持する値は Faker から切り離された Copy なので、Restore した後に Faker を操作しても Snapshot は変化しない
+type Snapshot struct {
+	// CreateTaskRequests is CreateTask が呼ばれた時の Request が順番に入っている
+	CreateTaskRequests []*taskspb.CreateTaskRequest
+
+	// MockResponsesForIndex is AddMockResponse, AddMockResponseWithIndex で登録された Mock Response
+	MockResponsesForIndex map[int]*MockResponse
+
+	// MockResponsesForTaskName is AddMockResponseWithTaskName で登録された Mock Response
+	MockResponsesForTaskName map[string]*MockResponse
+
+	// MockResponseIndex is AddMockResponse が次に登録する時に使う Index の1つ前の値
+	MockResponseIndex int
+}
+
+// MockResponse is Snapshot に含まれる Mock Response
+type MockResponse struct {
+	Err  error
+	Resp []proto.Message
+}
+
+// Snapshot is 現在の Faker の状態を Snapshot として取得する
+func (f *Faker) Snapshot() *Snapshot {
+	f.mock.mutex.RLock()
+	defer f.mock.mutex.RUnlock()
+
+	s := &Snapshot{
+		MockResponsesForIndex:    make(map[int]*MockResponse, len(f.mock.mockResponseForIndex)),
+		MockResponsesForTaskName: make(map[string]*MockResponse, len(f.mock.mockResponseForTaskName)),
+		MockResponseIndex:        f.mockForIndexResponseIndex,
+	}
+	for _, req := range f.mock.callCreateTaskReqs {
+		s.CreateTaskRequests = append(s.CreateTaskRequests, proto.Clone(req).(*taskspb.CreateTaskRequest))
+	}
+	for k, v := range f.mock.mockResponseForIndex {
+		s.MockResponsesForIndex[k] = v.toMockResponse()
+	}
+	for k, v := range f.mock.mockResponseForTaskName {
+		s.MockResponsesForTaskName[k] = v.toMockResponse()
+	}
+	return s
+}
+
+// Restore is Snapshot の状態に Faker を戻す
+// Restore する前の呼び出し履歴や Mock Response は破棄される
+// nil の Mock Response は登録されていないものとして扱う
+func (f *Faker) Restore(s *Snapshot) {
+	f.mock.mutex.Lock()
+	defer f.mock.mutex.Unlock()
+
+	var reqs []*taskspb.CreateTaskRequest
+	for _, req := range s.CreateTaskRequests {
+		reqs = append(reqs, proto.Clone(req).(*taskspb.CreateTaskRequest))
+	}
+	f.mock.callCreateTaskReqs = reqs
+
+	f.mock.mockResponseForIndex = make(map[int]*mockTaskResponse, len(s.MockResponsesForIndex))
+	for k, v := range s.MockResponsesForIndex {
+		if v == nil {
+			continue
+		}
+		f.mock.mockResponseForIndex[k] = v.toMockTaskResponse()
+	}
+	f.mock.mockResponseForTaskName = make(map[string]*mockTaskResponse, len(s.MockResponsesForTaskName))
+	for k, v := range s.MockResponsesForTaskName {
+		if v == nil {
+			continue
+		}
+		f.mock.mockResponseForTaskName[k] = v.toMockTaskResponse()
+	}
+	f.mockForIndexResponseIndex = s.MockResponseIndex
+}
+
+// WriteSnapshotFile is 現在の Faker の状態を JSON にして指定した file に書き込む
+func (f *Faker) WriteSnapshotFile(path string) error {
+	b, err := json.MarshalIndent(f.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// RestoreFromSnapshotFile is WriteSnapshotFile で書き込んだ file を読み込んで、Faker をその状態に戻す
+func (f *Faker) RestoreFromSnapshotFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("failed read snapshot %s : %w", path, err)
+	}
+	f.Restore(&s)
+	return nil
+}
+
+func (r *mockTaskResponse) toMockResponse() *MockResponse {
+	return &MockResponse{
+		Err:  r.err,
+		Resp: cloneMessages(r.resp),
+	}
+}
+
+func (r *MockResponse) toMockTaskResponse() *mockTaskResponse {
+	return &mockTaskResponse{
+		err:  r.Err,
+		resp: cloneMessages(r.Resp),
+	}
+}
+
+func cloneMessages(msgs []proto.Message) []proto.Message {
+	var l []proto.Message
+	for _, m := range msgs {
+		l = append(l, proto.Clone(m))
+	}
+	return l
+}
+
+type snapshotJSON struct {
+	CreateTaskRequests       []json.RawMessage        `json:"createTaskRequests"`
+	MockResponsesForIndex    map[int]*MockResponse    `json:"mockResponsesForIndex"`
+	MockResponsesForTaskName map[string]*MockResponse `json:"mockResponsesForTaskName"`
+	MockResponseIndex        int                      `json:"mockResponseIndex"`
+}
+
+// MarshalJSON is proto.Message を protojson で表現した JSON を返す
+func (s *Snapshot) MarshalJSON() ([]byte, error) {
+	v := &snapshotJSON{
+		MockResponsesForIndex:    s.MockResponsesForIndex,
+		MockResponsesForTaskName: s.MockResponsesForTaskName,
+		MockResponseIndex:        s.MockResponseIndex,
+	}
+	for _, req := range s.CreateTaskRequests {
+		b, err := protojson.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		v.CreateTaskRequests = append(v.CreateTaskRequests, b)
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON is MarshalJSON で出力した JSON から Snapshot を復元する
+func (s *Snapshot) UnmarshalJSON(b []byte) error {
+	var v snapshotJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var reqs []*taskspb.CreateTaskRequest
+	for _, raw := range v.CreateTaskRequests {
+		req := &taskspb.CreateTaskRequest{}
+		if err := protojson.Unmarshal(raw, req); err != nil {
+			return err
+		}
+		reqs = append(reqs, req)
+	}
+	// file の中の null の Mock Response は Restore できないので error にする
+	for k, r := range v.MockResponsesForIndex {
+		if r == nil {
+			return fmt.Errorf("invalid snapshot entry %q", fmt.Sprint(k))
+		}
+	}
+	for k, r := range v.MockResponsesForTaskName {
+		if r == nil {
+			return fmt.Errorf("invalid snapshot entry %q", k)
+		}
+	}
+	s.CreateTaskRequests = reqs
+	s.MockResponsesForIndex = v.MockResponsesForIndex
+	s.MockResponsesForTaskName = v.MockResponsesForTaskName
+	s.MockResponseIndex = v.MockResponseIndex
+	return nil
+}
+
+type mockResponseErrorJSON struct {
+	Code    codes.Code `json:"code"`
+	Message string     `json:"message"`
+}
+
+type mockResponseJSON struct {
+	Err  *mockResponseErrorJSON `json:"error,omitempty"`
+	Resp []json.RawMessage      `json:"resp"`
+}
+
+// MarshalJSON is Err を gRPC の Status として、Resp を型情報付きの protojson として出力する
+func (r *MockResponse) MarshalJSON() ([]byte, error) {
+	v := &mockResponseJSON{}
+	if r.Err != nil {
+		st := status.Convert(r.Err)
+		v.Err = &mockResponseErrorJSON{
+			Code:    st.Code(),
+			Message: st.Message(),
+		}
+	}
+	for _, m := range r.Resp {
+		a, err := anypb.New(m)
+		if err != nil {
+			return nil, err
+		}
+		b, err := protojson.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		v.Resp = append(v.Resp, b)
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON is MarshalJSON で出力した JSON から MockResponse を復元する
+// Err は gRPC の Status を持つ error として復元される
+func (r *MockResponse) UnmarshalJSON(b []byte) error {
+	var v mockResponseJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	r.Err = nil
+	if v.Err != nil {
+		r.Err = status.Error(v.Err.Code, v.Err.Message)
+	}
+	var msgs []proto.Message
+	for _, raw := range v.Resp {
+		a := &anypb.Any{}
+		if err := protojson.Unmarshal(raw, a); err != nil {
+			return err
+		}
+		m, err := a.UnmarshalNew()
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, m)
+	}
+	r.Resp = msgs
+	return nil
+}
@@ -0,0 +1,163 @@
+package cloudtasks_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	tasksfaker "github.com/sinmetalcraft/gcpfaker/cloudtasks"
+)
+
+func TestFaker_SnapshotAndRestore(t *testing.T) {
+	ctx := context.Background()
+
+	faker := tasksfaker.NewFaker(t)
+	defer faker.Stop()
+
+	c, err := cloudtasks.NewClient(ctx, faker.ClientOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := fmt.Sprintf("projects/%s/locations/%s/queues/%s", "[PROJECT]", "[LOCATION]", "[QUEUE]")
+	mockTaskName := fmt.Sprintf("%s/tasks/%s", parent, "mock")
+	faker.AddMockResponseWithTaskName(mockTaskName, nil, &taskspb.Task{Name: mockTaskName, DispatchCount: 99})
+	request := &taskspb.CreateTaskRequest{
+		Parent: parent,
+		Task:   &taskspb.Task{Name: fmt.Sprintf("%s/tasks/%s", parent, "seed")},
+	}
+	if _, err := c.CreateTask(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := faker.Snapshot()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.CreateTask(ctx, &taskspb.CreateTaskRequest{Parent: parent, Task: &taskspb.Task{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	faker.AddMockResponseWithTaskName(mockTaskName, nil, &taskspb.Task{Name: mockTaskName, DispatchCount: 1})
+	if e, g := 4, faker.GetCreateTaskCallCount(); e != g {
+		t.Fatalf("want createTaskCallCount %d but got %d", e, g)
+	}
+
+	faker.Restore(snapshot)
+
+	if e, g := 1, faker.GetCreateTaskCallCount(); e != g {
+		t.Errorf("want createTaskCallCount %d but got %d", e, g)
+	}
+	got, err := faker.GetCreateTaskRequest(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(request, got) {
+		t.Errorf("request want %q, but got %q", request, got)
+	}
+	resp, err := c.CreateTask(ctx, &taskspb.CreateTaskRequest{Parent: parent, Task: &taskspb.Task{Name: mockTaskName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int32(99), resp.GetDispatchCount(); e != g {
+		t.Errorf("want MockResponse.dispatchCount %d but got %d", e, g)
+	}
+}
+
+func TestFaker_SnapshotFile(t *testing.T) {
+	ctx := context.Background()
+
+	faker := tasksfaker.NewFaker(t)
+	defer faker.Stop()
+
+	c, err := cloudtasks.NewClient(ctx, faker.ClientOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := fmt.Sprintf("projects/%s/locations/%s/queues/%s", "[PROJECT]", "[LOCATION]", "[QUEUE]")
+	expectedResponse := &taskspb.Task{Name: fmt.Sprintf("%s/tasks/%s", parent, "indexed"), ResponseCount: 7}
+	faker.AddMockResponse(nil, expectedResponse)
+	faker.AddMockResponseWithTaskName("error", status.Error(codes.AlreadyExists, "task already exists"), &taskspb.Task{Name: "error"})
+	request := &taskspb.CreateTaskRequest{
+		Parent: parent,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					HttpMethod:  taskspb.HttpMethod_POST,
+					RelativeUri: "/tq/hoge",
+					Body:        []byte("hello"),
+				},
+			},
+		},
+	}
+	if _, err := c.CreateTask(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := faker.WriteSnapshotFile(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := tasksfaker.NewFaker(t)
+	defer restored.Stop()
+	if err := restored.RestoreFromSnapshotFile(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	want := faker.Snapshot()
+	got := restored.Snapshot()
+	if e, g := len(want.CreateTaskRequests), len(got.CreateTaskRequests); e != g {
+		t.Fatalf("want CreateTaskRequests.len %d but got %d", e, g)
+	}
+	if !proto.Equal(want.CreateTaskRequests[0], got.CreateTaskRequests[0]) {
+		t.Errorf("request want %q, but got %q", want.CreateTaskRequests[0], got.CreateTaskRequests[0])
+	}
+	if e, g := want.MockResponseIndex, got.MockResponseIndex; e != g {
+		t.Errorf("want MockResponseIndex %d but got %d", e, g)
+	}
+	if !proto.Equal(expectedResponse, got.MockResponsesForIndex[1].Resp[0]) {
+		t.Errorf("response want %q, but got %q", expectedResponse, got.MockResponsesForIndex[1].Resp[0])
+	}
+	if e, g := codes.AlreadyExists, status.Code(got.MockResponsesForTaskName["error"].Err); e != g {
+		t.Errorf("want error code %v but got %v", e, g)
+	}
+}
+
+func TestFaker_RestoreInvalidSnapshot(t *testing.T) {
+	faker := tasksfaker.NewFaker(t)
+	defer faker.Stop()
+
+	for name, body := range map[string]string{
+		"index":    `{"mockResponsesForIndex": {"1": null}}`,
+		"taskName": `{"mockResponsesForTaskName": {"hoge": null}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "snapshot.json")
+			if err := os.WriteFile(fn, []byte(body), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := faker.RestoreFromSnapshotFile(fn); err == nil {
+				t.Error("want error but got nil")
+			}
+		})
+	}
+
+	// nil の Mock Response は登録されていないものとして扱う
+	faker.Restore(&tasksfaker.Snapshot{
+		MockResponsesForIndex:    map[int]*tasksfaker.MockResponse{1: nil},
+		MockResponsesForTaskName: map[string]*tasksfaker.MockResponse{"hoge": nil},
+	})
+	s := faker.Snapshot()
+	if e, g := 0, len(s.MockResponsesForIndex)+len(s.MockResponsesForTaskName); e != g {
+		t.Errorf("want %d mock responses but got %d", e, g)
+	}
+}
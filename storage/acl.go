@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+const (
+	// fakeProjectNumber is stateful mode の Bucket が所属している Project の Number
+	fakeProjectNumber = "168610916801"
+
+	// fakeOwnerEntity is stateful mode で Object を作成した User
+	fakeOwnerEntity = "user-faker@example.com"
+)
+
+// aclResource is ACL の種類
+// JSON API の resource 名に合わせている
+type aclResource string
+
+const (
+	aclResourceObject        aclResource = "objectAccessControls"
+	aclResourceBucket        aclResource = "bucketAccessControls"
+	aclResourceDefaultObject aclResource = "defaultObjectAccessControls"
+)
+
+func errACLNotFound(entity string) error {
+	return &storeError{
+		code:    http.StatusNotFound,
+		reason:  "notFound",
+		message: fmt.Sprintf("No such ACL entity: %s", entity),
+	}
+}
+
+// projectTeamOf is project-owners-{project}, project-editors-{project}, project-viewers-{project} の Entity から ProjectTeam を返す
+// project の Entity ではない場合は nil を返す
+func projectTeamOf(entity string) *apigcs.ObjectAccessControlProjectTeam {
+	for _, team := range []string{"owners", "editors", "viewers"} {
+		prefix := fmt.Sprintf("project-%s-", team)
+		if strings.HasPrefix(entity, prefix) && len(entity) > len(prefix) {
+			return &apigcs.ObjectAccessControlProjectTeam{
+				ProjectNumber: entity[len(prefix):],
+				Team:          team,
+			}
+		}
+	}
+	return nil
+}
+
+// predefinedObjectACL is Object の predefinedAcl を ACL の rule に展開する
+func predefinedObjectACL(predefined string) ([]*apigcs.ObjectAccessControl, error) {
+	owner := &apigcs.ObjectAccessControl{Entity: fakeOwnerEntity, Role: "OWNER"}
+	projectOwners := "project-owners-" + fakeProjectNumber
+	switch predefined {
+	case "private":
+		return []*apigcs.ObjectAccessControl{owner}, nil
+	case "projectPrivate":
+		return append([]*apigcs.ObjectAccessControl{owner}, projectPrivateACL()...), nil
+	case "authenticatedRead":
+		return []*apigcs.ObjectAccessControl{owner, {Entity: "allAuthenticatedUsers", Role: "READER"}}, nil
+	case "publicRead":
+		return []*apigcs.ObjectAccessControl{owner, {Entity: "allUsers", Role: "READER"}}, nil
+	case "bucketOwnerFullControl":
+		return []*apigcs.ObjectAccessControl{owner, {Entity: projectOwners, Role: "OWNER"}}, nil
+	case "bucketOwnerRead":
+		return []*apigcs.ObjectAccessControl{owner, {Entity: projectOwners, Role: "READER"}}, nil
+	}
+	return nil, errInvalid(fmt.Sprintf("Invalid predefinedAcl: %s", predefined))
+}
+
+// applyPredefinedACL is predefinedAcl が指定されている場合に attrs の ACL を置き換える
+func applyPredefinedACL(attrs *apigcs.Object, predefined string) error {
+	if predefined == "" {
+		return nil
+	}
+	acl, err := predefinedObjectACL(predefined)
+	if err != nil {
+		return err
+	}
+	attrs.Acl = acl
+	return nil
+}
+
+// patchWithPredefinedACL is objects.patch の body の acl を predefinedAcl を展開したものに置き換える
+func patchWithPredefinedACL(patch []byte, predefined string) ([]byte, error) {
+	acl, err := predefinedObjectACL(predefined)
+	if err != nil {
+		return nil, err
+	}
+	p := make(map[string]interface{})
+	if len(patch) > 0 {
+		if err := json.Unmarshal(patch, &p); err != nil {
+			return nil, errInvalid(err.Error())
+		}
+	}
+	p["acl"] = acl
+	return json.Marshal(p)
+}
+
+// predefinedBucketACL is Bucket の predefinedAcl を ACL の rule に展開する
+func predefinedBucketACL(predefined string) ([]*apigcs.BucketAccessControl, error) {
+	var rules []*apigcs.ObjectAccessControl
+	switch predefined {
+	case "private":
+		rules = []*apigcs.ObjectAccessControl{{Entity: "project-owners-" + fakeProjectNumber, Role: "OWNER"}}
+	case "projectPrivate":
+		rules = projectPrivateACL()
+	case "authenticatedRead":
+		rules = append(projectPrivateACL()[:1], &apigcs.ObjectAccessControl{Entity: "allAuthenticatedUsers", Role: "READER"})
+	case "publicRead":
+		rules = append(projectPrivateACL()[:1], &apigcs.ObjectAccessControl{Entity: "allUsers", Role: "READER"})
+	case "publicReadWrite":
+		rules = append(projectPrivateACL()[:1], &apigcs.ObjectAccessControl{Entity: "allUsers", Role: "WRITER"})
+	default:
+		return nil, errInvalid(fmt.Sprintf("Invalid predefinedAcl: %s", predefined))
+	}
+	return toBucketACL(rules), nil
+}
+
+// projectPrivateACL is Project の owners, editors, viewers に Project の Role に合わせた権限を与える ACL
+// Bucket の ACL と Default Object ACL を指定しなかった時はこれになる
+func projectPrivateACL() []*apigcs.ObjectAccessControl {
+	return []*apigcs.ObjectAccessControl{
+		{Entity: "project-owners-" + fakeProjectNumber, Role: "OWNER"},
+		{Entity: "project-editors-" + fakeProjectNumber, Role: "OWNER"},
+		{Entity: "project-viewers-" + fakeProjectNumber, Role: "READER"},
+	}
+}
+
+// fillObjectACL is Object の ACL の rule の Server が決める項目を埋める
+func fillObjectACL(attrs *apigcs.Object) {
+	for _, rule := range attrs.Acl {
+		fillACLRule(rule, attrs.Bucket, attrs.Name, attrs.Generation)
+		rule.Kind = "storage#objectAccessControl"
+		rule.Id = fmt.Sprintf("%s/%s/%d/%s", attrs.Bucket, attrs.Name, attrs.Generation, rule.Entity)
+		rule.SelfLink = fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s/acl/%s", attrs.Bucket, url.PathEscape(attrs.Name), rule.Entity)
+		rule.Etag = attrs.Etag
+	}
+}
+
+// fillBucketACL is Bucket の ACL と Default Object ACL の rule の Server が決める項目を埋める
+func fillBucketACL(attrs *apigcs.Bucket) {
+	for _, rule := range attrs.Acl {
+		rule.Kind = "storage#bucketAccessControl"
+		rule.Bucket = attrs.Name
+		rule.Id = fmt.Sprintf("%s/%s", attrs.Name, rule.Entity)
+		rule.SelfLink = fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/acl/%s", attrs.Name, rule.Entity)
+		rule.Etag = attrs.Etag
+		rule.Email, rule.Domain = entityEmailAndDomain(rule.Entity)
+		if team := projectTeamOf(rule.Entity); team != nil {
+			rule.ProjectTeam = &apigcs.BucketAccessControlProjectTeam{
+				ProjectNumber: team.ProjectNumber,
+				Team:          team.Team,
+			}
+		}
+	}
+	for _, rule := range attrs.DefaultObjectAcl {
+		fillACLRule(rule, "", "", 0)
+		rule.Kind = "storage#objectAccessControl"
+		rule.Etag = attrs.Etag
+	}
+}
+
+func fillACLRule(rule *apigcs.ObjectAccessControl, bucket string, object string, generation int64) {
+	rule.Bucket = bucket
+	rule.Object = object
+	rule.Generation = generation
+	rule.Email, rule.Domain = entityEmailAndDomain(rule.Entity)
+	if team := projectTeamOf(rule.Entity); team != nil {
+		rule.ProjectTeam = team
+	}
+}
+
+// entityEmailAndDomain is user-{email}, group-{email}, domain-{domain} の Entity から Email と Domain を取り出す
+func entityEmailAndDomain(entity string) (email string, domain string) {
+	switch {
+	case strings.HasPrefix(entity, "user-"):
+		email = strings.TrimPrefix(entity, "user-")
+	case strings.HasPrefix(entity, "group-"):
+		email = strings.TrimPrefix(entity, "group-")
+	case strings.HasPrefix(entity, "domain-"):
+		domain = strings.TrimPrefix(entity, "domain-")
+	}
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		domain = email[i+1:]
+	}
+	return email, domain
+}
+
+// toBucketACL is ObjectAccessControl の rule を BucketAccessControl に変換する
+// Bucket の ACL も Object の ACL と同じ処理で扱うために、store の外では ObjectAccessControl で扱っている
+func toBucketACL(rules []*apigcs.ObjectAccessControl) []*apigcs.BucketAccessControl {
+	var l []*apigcs.BucketAccessControl
+	for _, r := range rules {
+		l = append(l, &apigcs.BucketAccessControl{Entity: r.Entity, EntityId: r.EntityId, Role: r.Role})
+	}
+	return l
+}
+
+func toObjectACL(rules []*apigcs.BucketAccessControl) []*apigcs.ObjectAccessControl {
+	var l []*apigcs.ObjectAccessControl
+	for _, r := range rules {
+		l = append(l, &apigcs.ObjectAccessControl{Entity: r.Entity, EntityId: r.EntityId, Role: r.Role})
+	}
+	return l
+}
+
+// setACLRule is rules の entity の Role を変更する
+// entity の rule が無い場合は追加する
+func setACLRule(rules []*apigcs.ObjectAccessControl, rule *apigcs.ObjectAccessControl) []*apigcs.ObjectAccessControl {
+	for _, r := range rules {
+		if r.Entity == rule.Entity {
+			r.Role = rule.Role
+			return rules
+		}
+	}
+	return append(rules, &apigcs.ObjectAccessControl{Entity: rule.Entity, Role: rule.Role})
+}
+
+// deleteACLRule is rules から entity の rule を取り除く
+func deleteACLRule(rules []*apigcs.ObjectAccessControl, entity string) ([]*apigcs.ObjectAccessControl, error) {
+	for i, r := range rules {
+		if r.Entity == entity {
+			return append(rules[:i:i], rules[i+1:]...), nil
+		}
+	}
+	return nil, errACLNotFound(entity)
+}
+
+// accessControls is resource の ACL の rule の一覧を返す
+// update が nil ではない場合は、update で変更した一覧を書き戻してから返す
+// 書き戻した場合は Object または Bucket の Metageneration が上がる
+func (s *store) accessControls(resource aclResource, bucket string, object string, cond *conditions, update func([]*apigcs.ObjectAccessControl) ([]*apigcs.ObjectAccessControl, error)) ([]*apigcs.ObjectAccessControl, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if resource == aclResourceObject {
+		o, err := s.lookupObject(bucket, object, cond)
+		if err != nil {
+			return nil, err
+		}
+		if update != nil {
+			rules, err := update(cloneObjectACL(o.attrs.Acl))
+			if err != nil {
+				return nil, err
+			}
+			o.attrs.Acl = rules
+			o.touch(now)
+		}
+		return cloneObjectACL(o.attrs.Acl), nil
+	}
+
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return nil, errBucketNotFound()
+	}
+	if update != nil {
+		current := cloneObjectACL(b.attrs.DefaultObjectAcl)
+		if resource == aclResourceBucket {
+			current = toObjectACL(b.attrs.Acl)
+		}
+		rules, err := update(current)
+		if err != nil {
+			return nil, err
+		}
+		if resource == aclResourceBucket {
+			b.attrs.Acl = toBucketACL(rules)
+		} else {
+			b.attrs.DefaultObjectAcl = rules
+		}
+		b.touch(now)
+	}
+	if resource == aclResourceBucket {
+		return toObjectACL(b.attrs.Acl), nil
+	}
+	return cloneObjectACL(b.attrs.DefaultObjectAcl), nil
+}
+
+func cloneObjectACL(rules []*apigcs.ObjectAccessControl) []*apigcs.ObjectAccessControl {
+	var l []*apigcs.ObjectAccessControl
+	for _, r := range rules {
+		v := *r
+		if r.ProjectTeam != nil {
+			team := *r.ProjectTeam
+			v.ProjectTeam = &team
+		}
+		l = append(l, &v)
+	}
+	return l
+}
+
+// accessControl is objectAccessControls, bucketAccessControls, defaultObjectAccessControls の Request を処理する
+func (s *server) accessControl(w http.ResponseWriter, r *http.Request, ar *apiRequest, cond *conditions) {
+	var rules []*apigcs.ObjectAccessControl
+	var err error
+	switch {
+	case ar.method == http.MethodGet:
+		rules, err = s.store.accessControls(ar.acl, ar.bucket, ar.object, cond, nil)
+	case ar.method == http.MethodDelete && ar.entity != "":
+		rules, err = s.store.accessControls(ar.acl, ar.bucket, ar.object, cond, func(current []*apigcs.ObjectAccessControl) ([]*apigcs.ObjectAccessControl, error) {
+			return deleteACLRule(current, ar.entity)
+		})
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case ar.method == http.MethodPost && ar.entity == "",
+		(ar.method == http.MethodPut || ar.method == http.MethodPatch) && ar.entity != "":
+		var rule apigcs.ObjectAccessControl
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeError(w, ar, errInvalid(err.Error()))
+			return
+		}
+		if ar.entity != "" {
+			rule.Entity = ar.entity
+		}
+		if rule.Entity == "" || rule.Role == "" {
+			writeError(w, ar, errInvalid("Required entity and role are missing."))
+			return
+		}
+		ar.entity = rule.Entity
+		rules, err = s.store.accessControls(ar.acl, ar.bucket, ar.object, cond, func(current []*apigcs.ObjectAccessControl) ([]*apigcs.ObjectAccessControl, error) {
+			return setACLRule(current, &rule), nil
+		})
+	default:
+		writeError(w, ar, &storeError{
+			code:    http.StatusNotImplemented,
+			reason:  "notImplemented",
+			message: fmt.Sprintf("%s %s is not supported by gcpfaker", r.Method, r.URL.String()),
+		})
+		return
+	}
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+
+	if ar.entity == "" {
+		if ar.acl == aclResourceBucket {
+			writeJSON(w, http.StatusOK, &apigcs.BucketAccessControls{Kind: "storage#bucketAccessControls", Items: s.bucketACLItems(ar.bucket, rules)})
+			return
+		}
+		writeJSON(w, http.StatusOK, &apigcs.ObjectAccessControls{Kind: "storage#objectAccessControls", Items: rules})
+		return
+	}
+	if ar.acl == aclResourceBucket {
+		for _, rule := range s.bucketACLItems(ar.bucket, rules) {
+			if rule.Entity == ar.entity {
+				writeJSON(w, http.StatusOK, rule)
+				return
+			}
+		}
+	} else {
+		for _, rule := range rules {
+			if rule.Entity == ar.entity {
+				writeJSON(w, http.StatusOK, rule)
+				return
+			}
+		}
+	}
+	writeError(w, ar, errACLNotFound(ar.entity))
+}
+
+// bucketACLItems is store から読んだ Bucket の ACL を BucketAccessControl にする
+func (s *server) bucketACLItems(bucket string, rules []*apigcs.ObjectAccessControl) []*apigcs.BucketAccessControl {
+	attrs := &apigcs.Bucket{Name: bucket, Acl: toBucketACL(rules)}
+	if b, err := s.store.getBucket(bucket); err == nil {
+		attrs.Etag = b.Etag
+	}
+	fillBucketACL(attrs)
+	return attrs.Acl
+}
@@ -0,0 +1,171 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func findACLRule(rules []storage.ACLRule, entity storage.ACLEntity) *storage.ACLRule {
+	for _, rule := range rules {
+		if rule.Entity == entity {
+			rule := rule
+			return &rule
+		}
+	}
+	return nil
+}
+
+func TestStatefulFaker_ObjectACL(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "acl.txt"
+	writeObject(t, stg, bucket, object, "acl")
+	acl := stg.Bucket(bucket).Object(object).ACL()
+
+	rules, err := acl.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := findACLRule(rules, "project-owners-168610916801")
+	if owners == nil {
+		t.Fatalf("project owners is not found in %v", rules)
+	}
+	if owners.ProjectTeam == nil || owners.ProjectTeam.Team != "owners" || owners.ProjectTeam.ProjectNumber != "168610916801" {
+		t.Errorf("unexpected ProjectTeam %+v", owners.ProjectTeam)
+	}
+
+	const entity = storage.ACLEntity("user-sinmetal@example.com")
+	if err := acl.Set(ctx, entity, storage.RoleReader); err != nil {
+		t.Fatal(err)
+	}
+	rules, err = acl.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := findACLRule(rules, entity)
+	if rule == nil {
+		t.Fatalf("%s is not found in %v", entity, rules)
+	}
+	if e, g := storage.RoleReader, rule.Role; e != g {
+		t.Errorf("want role %s but got %s", e, g)
+	}
+	if e, g := "sinmetal@example.com", rule.Email; e != g {
+		t.Errorf("want email %s but got %s", e, g)
+	}
+
+	if err := acl.Delete(ctx, entity); err != nil {
+		t.Fatal(err)
+	}
+	rules, err = acl.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := findACLRule(rules, entity); rule != nil {
+		t.Errorf("%s is not deleted", entity)
+	}
+	err = acl.Delete(ctx, entity)
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		t.Fatalf("want googleapi.Error but got %v", err)
+	}
+	if e, g := http.StatusNotFound, gerr.Code; e != g {
+		t.Errorf("want status %d but got %d", e, g)
+	}
+}
+
+func TestStatefulFaker_BucketACL(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake-acl"
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const entity = storage.ACLEntity("group-team@example.com")
+	if err := stg.Bucket(bucket).ACL().Set(ctx, entity, storage.RoleWriter); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := stg.Bucket(bucket).ACL().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := findACLRule(rules, entity); rule == nil || rule.Role != storage.RoleWriter {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+	if err := stg.Bucket(bucket).ACL().Delete(ctx, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	// Default Object ACL はその後に作成した Object の ACL になる
+	if err := stg.Bucket(bucket).DefaultObjectACL().Set(ctx, storage.AllAuthenticatedUsers, storage.RoleReader); err != nil {
+		t.Fatal(err)
+	}
+	writeObject(t, stg, bucket, "inherit.txt", "inherit")
+	rules, err = stg.Bucket(bucket).Object("inherit.txt").ACL().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := findACLRule(rules, storage.AllAuthenticatedUsers); rule == nil || rule.Role != storage.RoleReader {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+}
+
+func TestStatefulFaker_PredefinedACL(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "public.txt"
+	w := stg.Bucket(bucket).Object(object).NewWriter(ctx)
+	w.PredefinedACL = "publicRead"
+	if _, err := w.Write([]byte("public")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rule := findACLRule(w.Attrs().ACL, storage.AllUsers); rule == nil || rule.Role != storage.RoleReader {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+	if rule := findACLRule(w.Attrs().ACL, "project-viewers-168610916801"); rule != nil {
+		t.Errorf("publicRead should not contain project viewers. %+v", rule)
+	}
+}
+
+// TestObjectListACLProjectTeam is Entity が project の場合に ProjectTeam が埋まることを確認する
+func TestObjectListACLProjectTeam(t *testing.T) {
+	ctx := context.Background()
+
+	faker := storagefaker.NewFaker(t)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "hoge.txt"
+	rules := []storage.ACLRule{
+		{Entity: "project-editors-123456", Role: storage.RoleOwner},
+	}
+	if err := faker.AddListObjectACLOKResponse(bucket, object, rules); err != nil {
+		t.Fatal(err)
+	}
+	got, err := stg.Bucket(bucket).Object(object).ACL().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := (&storage.ProjectTeam{ProjectNumber: "123456", Team: "editors"}), got[0].ProjectTeam; g == nil || *e != *g {
+		t.Errorf("want ProjectTeam %+v but got %+v", e, g)
+	}
+}
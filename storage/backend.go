@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+)
+
+// Backend is stateful mode の store が Object の中身を保存する先
+//
+// store は Object の metadata だけを memory に持ち、中身は Backend に書き込んで Blob として参照する
+// 大きな Object を扱う Test では NewTempDirBackend を使うと、中身を memory に載せずに Upload や Download ができる
+type Backend interface {
+	// NewBlob is Object の中身を少しずつ書き込むための BlobWriter を返す
+	NewBlob() (BlobWriter, error)
+}
+
+// BlobWriter is Backend に Object の中身を書き込む
+// Resumable Upload の chunk のように、何回かに分けて Write してから Commit する
+type BlobWriter interface {
+	io.Writer
+
+	// Commit is 書き込みを終えて、書き込んだ中身を読む Blob を返す
+	Commit() (Blob, error)
+
+	// Abort is 書き込みを止めて、書き込んだ中身を捨てる
+	Abort() error
+}
+
+// Blob is Backend に保存した Object の中身
+// 書き込んだ後は変更しないので、複数の Generation や Request から同時に読まれる
+type Blob interface {
+	// Size is 中身の byte 数
+	Size() int64
+
+	// Open is 中身を読む io.ReadSeekCloser を返す
+	// 読み終わったら Close する
+	Open() (io.ReadSeekCloser, error)
+
+	// Release is 中身を捨てる
+	// Object の上書きや削除で、store がこの Blob を最後に参照していた Object や Generation を手放した時に呼ばれる
+	Release() error
+}
+
+// MemoryBackend is Object の中身を memory に保持する Backend
+// NewStatefulFaker はこの Backend を使う
+type MemoryBackend struct{}
+
+var _ Backend = &MemoryBackend{}
+
+// NewMemoryBackend is MemoryBackend を作成する
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+// NewBlob is memory に書き込む BlobWriter を返す
+func (b *MemoryBackend) NewBlob() (BlobWriter, error) {
+	return &memoryBlobWriter{}, nil
+}
+
+type memoryBlobWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *memoryBlobWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryBlobWriter) Commit() (Blob, error) {
+	return memoryBlob(w.buf.Bytes()), nil
+}
+
+func (w *memoryBlobWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
+
+// memoryBlob is memory に保持した Object の中身
+type memoryBlob []byte
+
+func (b memoryBlob) Size() int64 {
+	return int64(len(b))
+}
+
+func (b memoryBlob) Open() (io.ReadSeekCloser, error) {
+	return nopSeekCloser{bytes.NewReader(b)}, nil
+}
+
+// Release is 何もしない
+// 参照が無くなれば GC が回収する
+func (b memoryBlob) Release() error {
+	return nil
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// TempDirBackend is Object の中身を一時 directory の file に保存する Backend
+//
+// 書き込んだ file は Object の上書きや削除で参照されなくなった時に削除し、残った file は TempDirBackend を Close した時にまとめて削除する
+// NewTempDirBackend で作成した場合は t.Cleanup で Close する
+type TempDirBackend struct {
+	dir string
+}
+
+var _ Backend = &TempDirBackend{}
+
+// NewTempDirBackend is t.TempDir に Object の中身を保存する TempDirBackend を作成する
+// Test の終了時に t.Cleanup で Close する
+func NewTempDirBackend(t *testing.T) *TempDirBackend {
+	t.Helper()
+
+	b := &TempDirBackend{dir: t.TempDir()}
+	t.Cleanup(func() {
+		_ = b.Close()
+	})
+	return b
+}
+
+// NewTempDirBackendWithoutTesting is testing.T を使わずに一時 directory を作成して、TempDirBackend を作成する
+// 使い終わったら Close を呼ぶ
+func NewTempDirBackendWithoutTesting() (*TempDirBackend, error) {
+	dir, err := os.MkdirTemp("", "gcpfaker-storage-")
+	if err != nil {
+		return nil, fmt.Errorf("failed create temp dir : %w", err)
+	}
+	return &TempDirBackend{dir: dir}, nil
+}
+
+// Dir is Object の中身を保存している directory を返す
+func (b *TempDirBackend) Dir() string {
+	return b.dir
+}
+
+// Close is 一時 directory を削除する
+func (b *TempDirBackend) Close() error {
+	return os.RemoveAll(b.dir)
+}
+
+// NewBlob is 一時 directory に新しい file を作成して、そこに書き込む BlobWriter を返す
+func (b *TempDirBackend) NewBlob() (BlobWriter, error) {
+	f, err := os.CreateTemp(b.dir, "blob-")
+	if err != nil {
+		return nil, err
+	}
+	return &fileBlobWriter{f: f}, nil
+}
+
+type fileBlobWriter struct {
+	f    *os.File
+	size int64
+}
+
+func (w *fileBlobWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *fileBlobWriter) Commit() (Blob, error) {
+	if err := w.f.Close(); err != nil {
+		return nil, err
+	}
+	return &fileBlob{path: w.f.Name(), size: w.size}, nil
+}
+
+func (w *fileBlobWriter) Abort() error {
+	_ = w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// fileBlob is 一時 directory の file に保存した Object の中身
+type fileBlob struct {
+	path string
+	size int64
+}
+
+func (b *fileBlob) Size() int64 {
+	return b.size
+}
+
+func (b *fileBlob) Open() (io.ReadSeekCloser, error) {
+	return os.Open(b.path)
+}
+
+// Release is file を削除する
+func (b *fileBlob) Release() error {
+	return os.Remove(b.path)
+}
+
+// hashingWriter is 書き込んだ中身の MD5 と CRC32C を計算する
+// Object の中身を memory に載せずに Hash を求めるために使う
+type hashingWriter struct {
+	md5    hash.Hash
+	crc32c hash.Hash32
+}
+
+func newHashingWriter() *hashingWriter {
+	return &hashingWriter{
+		md5:    md5.New(),
+		crc32c: crc32.New(crc32cTable),
+	}
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	_, _ = w.md5.Write(p)
+	_, _ = w.crc32c.Write(p)
+	return len(p), nil
+}
+
+// sum is これまでに書き込んだ中身の objectHash を返す
+func (w *hashingWriter) sum() *objectHash {
+	return &objectHash{
+		md5:    base64.StdEncoding.EncodeToString(w.md5.Sum(nil)),
+		crc32c: encodeCRC32C(w.crc32c.Sum32()),
+	}
+}
+
+// hashReader is r を最後まで読んで、中身の objectHash を返す
+func hashReader(r io.Reader) (*objectHash, error) {
+	w := newHashingWriter()
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	return w.sum(), nil
+}
+
+// writeBlob is r を最後まで読んで backend に書き込み、Blob と中身の objectHash を返す
+func writeBlob(backend Backend, r io.Reader) (Blob, *objectHash, error) {
+	w, err := backend.NewBlob()
+	if err != nil {
+		return nil, nil, err
+	}
+	h := newHashingWriter()
+	if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+		_ = w.Abort()
+		return nil, nil, err
+	}
+	blob, err := w.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return blob, h.sum(), nil
+}
+
+// readBlob is Blob の中身を全て読み込む
+// Object の中身を []byte で扱う必要がある所だけで使う
+func readBlob(blob Blob) ([]byte, error) {
+	r, err := blob.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,344 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func TestStatefulFaker_TempDirBackend(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+
+	backend := storagefaker.NewTempDirBackend(t)
+	faker := storagefaker.NewStatefulFakerWithBackend(t, backend)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 複数の chunk に分かれる Resumable Upload
+	body := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	w := stg.Bucket(bucket).Object("large.bin").NewWriter(ctx)
+	w.ChunkSize = 256 * 1024
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int64(len(body)), w.Attrs().Size; e != g {
+		t.Errorf("want Size %d but got %d", e, g)
+	}
+	if e, g := crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)), w.Attrs().CRC32C; e != g {
+		t.Errorf("want CRC32C %d but got %d", e, g)
+	}
+
+	r, err := stg.Bucket(bucket).Object("large.bin").NewReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, got) {
+		t.Errorf("want %d bytes but got %d bytes", len(body), len(got))
+	}
+
+	rr, err := stg.Bucket(bucket).Object("large.bin").NewRangeReader(ctx, 300*1024, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := string(body[300*1024:300*1024+10]), string(got); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+
+	writeObject(t, stg, bucket, "a.txt", "Hello ")
+	writeObject(t, stg, bucket, "b.txt", "Backend")
+	dst := stg.Bucket(bucket).Object("composed.txt")
+	if _, err := dst.ComposerFrom(stg.Bucket(bucket).Object("a.txt"), stg.Bucket(bucket).Object("b.txt")).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "Hello Backend", readObject(t, stg, bucket, "composed.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	if _, err := stg.Bucket(bucket).Object("copied.txt").CopierFrom(dst).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "Hello Backend", readObject(t, stg, bucket, "copied.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+
+	entries, err := os.ReadDir(backend.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// large.bin, a.txt, b.txt, composed.txt の中身が file になり、copied.txt は composed.txt の中身を共有する
+	if e, g := 4, len(entries); e != g {
+		t.Errorf("want %d blob files but got %d", e, g)
+	}
+}
+
+func TestStatefulFaker_TempDirBackendReleasesBlobs(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+	const versioned = "sinmetal-ci-fake-versioned"
+
+	backend := storagefaker.NewTempDirBackend(t)
+	faker := storagefaker.NewStatefulFakerWithBackend(t, backend)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := stg.Bucket(versioned).Create(ctx, "sinmetal-ci", &storage.BucketAttrs{VersioningEnabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	blobFiles := func() int {
+		t.Helper()
+		entries, err := os.ReadDir(backend.Dir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	t.Run("overwrite", func(t *testing.T) {
+		for _, body := range []string{"Hello", "Hello World", "Hello Backend"} {
+			writeObject(t, stg, bucket, "a.txt", body)
+		}
+		if e, g := 1, blobFiles(); e != g {
+			t.Errorf("want %d blob files but got %d", e, g)
+		}
+	})
+	t.Run("copy shares blob", func(t *testing.T) {
+		if _, err := stg.Bucket(bucket).Object("b.txt").CopierFrom(stg.Bucket(bucket).Object("a.txt")).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := stg.Bucket(bucket).Object("a.txt").Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if e, g := 1, blobFiles(); e != g {
+			t.Errorf("want %d blob files but got %d", e, g)
+		}
+		if e, g := "Hello Backend", readObject(t, stg, bucket, "b.txt"); e != g {
+			t.Errorf("want %q but got %q", e, g)
+		}
+		if err := stg.Bucket(bucket).Object("b.txt").Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if e, g := 0, blobFiles(); e != g {
+			t.Errorf("want %d blob files but got %d", e, g)
+		}
+	})
+	t.Run("compose", func(t *testing.T) {
+		writeObject(t, stg, bucket, "c1.txt", "Hello ")
+		writeObject(t, stg, bucket, "c2.txt", "Compose")
+		dst := stg.Bucket(bucket).Object("composed.txt")
+		if _, err := dst.ComposerFrom(stg.Bucket(bucket).Object("c1.txt"), stg.Bucket(bucket).Object("c2.txt")).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if e, g := 3, blobFiles(); e != g {
+			t.Errorf("want %d blob files but got %d", e, g)
+		}
+		for _, object := range []string{"c1.txt", "c2.txt", "composed.txt"} {
+			if err := stg.Bucket(bucket).Object(object).Delete(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if e, g := 0, blobFiles(); e != g {
+			t.Errorf("want %d blob files but got %d", e, g)
+		}
+	})
+	t.Run("noncurrent generations", func(t *testing.T) {
+		first := writeObject(t, stg, versioned, "v.txt", "v1")
+		second := writeObject(t, stg, versioned, "v.txt", "v2")
+		if err := stg.Bucket(versioned).Object("v.txt").Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		// Versioning が有効な Bucket では noncurrent な Generation の中身が残る
+		if e, g := 2, blobFiles(); e != g {
+			t.Errorf("want %d blob files but got %d", e, g)
+		}
+		for _, attrs := range []*storage.ObjectAttrs{first, second} {
+			if err := stg.Bucket(versioned).Object("v.txt").Generation(attrs.Generation).Delete(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if e, g := 0, blobFiles(); e != g {
+			t.Errorf("want %d blob files but got %d", e, g)
+		}
+	})
+}
+
+func TestStatefulFaker_RecordedBodySizeLimit(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+
+	faker, stg := newStatefulClient(t)
+	faker.SetMaxRecordedBodySize(1024)
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Repeat("a", 4096)
+	w := stg.Bucket(bucket).Object("multipart.txt").NewWriter(ctx)
+	w.ChunkSize = 0
+	w.ContentType = "text/plain"
+	w.Metadata = map[string]string{"owner": "sinmetal"}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// chunk より大きいので Resumable Upload になる
+	large := strings.Repeat("b", 256*1024+10)
+	w = stg.Bucket(bucket).Object("resumable.txt").NewWriter(ctx)
+	w.ChunkSize = 256 * 1024
+	w.ContentType = "text/plain"
+	if _, err := w.Write([]byte(large)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, g := body, readObject(t, stg, bucket, "multipart.txt"); e != g {
+		t.Errorf("want %d bytes but got %d bytes", len(e), len(g))
+	}
+	if e, g := large, readObject(t, stg, bucket, "resumable.txt"); e != g {
+		t.Errorf("want %d bytes but got %d bytes", len(e), len(g))
+	}
+
+	uploads := faker.Uploads(bucket, "multipart.txt")
+	if e, g := 1, len(uploads); e != g {
+		t.Fatalf("want %d uploads but got %d", e, g)
+	}
+	if uploads[0].Content != nil {
+		t.Errorf("want nil content but got %d bytes", len(uploads[0].Content))
+	}
+	if uploads[0].Request.Body != nil {
+		t.Errorf("want nil body but got %d bytes", len(uploads[0].Request.Body))
+	}
+	if e, g := "sinmetal", uploads[0].Attrs.Metadata["owner"]; e != g {
+		t.Errorf("want metadata %q but got %q", e, g)
+	}
+
+	uploads = faker.Uploads(bucket, "resumable.txt")
+	if e, g := 1, len(uploads); e != g {
+		t.Fatalf("want %d uploads but got %d", e, g)
+	}
+	if uploads[0].Content != nil {
+		t.Errorf("want nil content but got %d bytes", len(uploads[0].Content))
+	}
+	if e, g := int64(len(large)), uploads[0].Attrs.Size; e != g {
+		t.Errorf("want Size %d but got %d", e, g)
+	}
+}
+
+func TestNewTempDirBackendWithoutTesting(t *testing.T) {
+	backend, err := storagefaker.NewTempDirBackendWithoutTesting()
+	if err != nil {
+		t.Fatal(err)
+	}
+	faker := storagefaker.NewStatefulFakerWithBackendWithoutTesting(backend)
+	stg, err := storage.NewClient(context.Background(), option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stg.Bucket("sinmetal-ci-fake").Create(context.Background(), "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeObject(t, stg, "sinmetal-ci-fake", "hello.txt", "Hello")
+
+	if err := backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backend.Dir()); !os.IsNotExist(err) {
+		t.Errorf("want temp dir is removed but got %v", err)
+	}
+}
+
+func TestStatefulFaker_LargeResumableUploadMemory(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+	const chunkSize = 8 << 20
+	const size = 64 << 20
+
+	faker := storagefaker.NewStatefulFakerWithBackend(t, storagefaker.NewTempDirBackend(t))
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	// Test 自身が中身を memory に持たないように、同じ 1MiB を繰り返し書き込む
+	buf := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	w := stg.Bucket(bucket).Object("large.bin").NewWriter(ctx)
+	w.ChunkSize = chunkSize
+	for written := 0; written < size; written += len(buf) {
+		if _, err := w.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int64(size), w.Attrs().Size; e != g {
+		t.Fatalf("want Size %d but got %d", e, g)
+	}
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// 初期設定のままでも、Upload した中身は chunk の body としても Uploads の Content としても memory に残らない
+	if growth := int64(after.HeapAlloc) - int64(before.HeapAlloc); growth > 2*chunkSize {
+		t.Errorf("heap grew %d bytes after uploading %d bytes", growth, size)
+	}
+	uploads := faker.Uploads(bucket, "large.bin")
+	if e, g := 1, len(uploads); e != g {
+		t.Fatalf("want %d uploads but got %d", e, g)
+	}
+	if uploads[0].Content != nil {
+		t.Errorf("want nil content but got %d bytes", len(uploads[0].Content))
+	}
+	for _, r := range faker.Requests() {
+		if r.Operation == "objects.insert.resumable" && r.Body != nil {
+			t.Errorf("want chunk body is not recorded but got %d bytes", len(r.Body))
+		}
+	}
+}
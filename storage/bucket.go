@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+func errBucketAlreadyExists() error {
+	return &storeError{
+		code:    http.StatusConflict,
+		reason:  "conflict",
+		message: "Your previous request to create the named bucket succeeded and you already own it.",
+	}
+}
+
+func errBucketNotEmpty() error {
+	return &storeError{
+		code:    http.StatusConflict,
+		reason:  "conflict",
+		message: "The bucket you tried to delete is not empty.",
+	}
+}
+
+// defaultBucketLocation is Location を指定せずに Bucket を作成した時の Location
+const defaultBucketLocation = "US"
+
+// newBucketEntry is attrs の中で Client が指定できる項目を使って Bucket を作る
+// Location, StorageClass, ACL を指定していない場合は GCS と同じ値にする
+func newBucketEntry(attrs *apigcs.Bucket, now time.Time) *bucketEntry {
+	v := *attrs
+	b := &bucketEntry{
+		attrs:      &v,
+		objects:    make(map[string]*objectEntry),
+		noncurrent: make(map[string][]*objectEntry),
+	}
+	b.attrs.Acl = toBucketACL(toObjectACL(attrs.Acl))
+	b.attrs.DefaultObjectAcl = cloneObjectACL(attrs.DefaultObjectAcl)
+	if len(b.attrs.Acl) == 0 {
+		b.attrs.Acl = toBucketACL(projectPrivateACL())
+	}
+	if len(b.attrs.DefaultObjectAcl) == 0 {
+		b.attrs.DefaultObjectAcl = projectPrivateACL()
+	}
+	if b.attrs.Location == "" {
+		b.attrs.Location = defaultBucketLocation
+	}
+	b.attrs.Location = strings.ToUpper(b.attrs.Location)
+	b.attrs.LocationType = locationTypeOf(b.attrs.Location)
+	if b.attrs.StorageClass == "" {
+		b.attrs.StorageClass = "STANDARD"
+	}
+	b.attrs.ProjectNumber = mustParseUint(fakeProjectNumber)
+	b.attrs.Metageneration = 1
+	b.attrs.TimeCreated = now.UTC().Format(time.RFC3339Nano)
+	b.attrs.Updated = b.attrs.TimeCreated
+	b.normalize(nil, now)
+	b.fillDerivedAttrs()
+	return b
+}
+
+// normalize is Client が指定した設定に合わせて、Server が決める項目を埋める
+// previous は変更前の Attrs で、作成時は nil
+func (b *bucketEntry) normalize(previous *apigcs.Bucket, now time.Time) {
+	a := b.attrs
+	if rp := a.RetentionPolicy; rp != nil {
+		if previous == nil || previous.RetentionPolicy == nil || previous.RetentionPolicy.RetentionPeriod != rp.RetentionPeriod {
+			rp.EffectiveTime = now.UTC().Format(time.RFC3339Nano)
+		}
+		if previous == nil || previous.RetentionPolicy == nil {
+			rp.IsLocked = false
+		} else {
+			rp.IsLocked = previous.RetentionPolicy.IsLocked
+		}
+	}
+	if ic := a.IamConfiguration; ic != nil && ic.UniformBucketLevelAccess != nil {
+		ubla := ic.UniformBucketLevelAccess
+		switch {
+		case !ubla.Enabled:
+			ubla.LockedTime = ""
+		case previous == nil || previous.IamConfiguration == nil || previous.IamConfiguration.UniformBucketLevelAccess == nil || !previous.IamConfiguration.UniformBucketLevelAccess.Enabled:
+			// Uniform Bucket Level Access は有効にしてから 90 日間だけ無効に戻せる
+			ubla.LockedTime = now.Add(90 * 24 * time.Hour).UTC().Format(time.RFC3339Nano)
+		default:
+			ubla.LockedTime = previous.IamConfiguration.UniformBucketLevelAccess.LockedTime
+		}
+		ic.BucketPolicyOnly = &apigcs.BucketIamConfigurationBucketPolicyOnly{
+			Enabled:    ubla.Enabled,
+			LockedTime: ubla.LockedTime,
+		}
+	}
+}
+
+// locationTypeOf is Location から LocationType を返す
+func locationTypeOf(location string) string {
+	switch location {
+	case "US", "EU", "ASIA":
+		return "multi-region"
+	case "ASIA1", "EUR4", "NAM4":
+		return "dual-region"
+	}
+	return "region"
+}
+
+func mustParseUint(v string) uint64 {
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// insertBucket is project に Bucket を作成する
+// 同じ名前の Bucket が既にある場合は 409 を返す
+func (s *store) insertBucket(project string, attrs *apigcs.Bucket) (*apigcs.Bucket, error) {
+	if attrs.Name == "" {
+		return nil, errInvalid("Required bucket name is missing.")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[attrs.Name]; ok {
+		return nil, errBucketAlreadyExists()
+	}
+	b := newBucketEntry(attrs, s.now())
+	b.project = project
+	s.buckets[attrs.Name] = b
+	return b.cloneAttrs(), nil
+}
+
+// getBucket is Bucket の Attrs を返す
+func (s *store) getBucket(bucket string) (*apigcs.Bucket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return nil, errBucketNotFound()
+	}
+	return b.cloneAttrs(), nil
+}
+
+// patchBucket is Bucket の Attrs を JSON Merge Patch で更新する
+func (s *store) patchBucket(bucket string, patch []byte, cond *conditions) (*apigcs.Bucket, error) {
+	var p map[string]interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, errInvalid(err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return nil, errBucketNotFound()
+	}
+	if err := cond.checkMetageneration(b.attrs.Metageneration); err != nil {
+		return nil, err
+	}
+	var updated apigcs.Bucket
+	if err := mergePatchJSON(b.attrs, p, immutableBucketFields, &updated); err != nil {
+		return nil, err
+	}
+	previous := b.attrs
+	if err := checkRetentionPolicyUpdate(previous, &updated); err != nil {
+		return nil, err
+	}
+	b.attrs = &updated
+	now := s.now()
+	b.normalize(previous, now)
+	if retentionPeriodOf(b.attrs) != retentionPeriodOf(previous) {
+		b.resetRetention()
+	}
+	b.touch(now)
+	return b.cloneAttrs(), nil
+}
+
+// deleteBucket is Bucket を削除する
+// noncurrent を含めて Object が残っている場合は 409 を返す
+func (s *store) deleteBucket(bucket string, cond *conditions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return errBucketNotFound()
+	}
+	if err := cond.checkMetageneration(b.attrs.Metageneration); err != nil {
+		return err
+	}
+	if len(b.objects) > 0 || len(b.noncurrent) > 0 {
+		return errBucketNotEmpty()
+	}
+	delete(s.buckets, bucket)
+	return nil
+}
+
+// listBuckets is project の prefix で始まる Bucket を名前順に返す
+// 暗黙的に作成された Project の無い Bucket は、どの project でも返す
+// project が空の場合は全ての Bucket を返す
+func (s *store) listBuckets(project string, prefix string) []*apigcs.Bucket {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var l []*apigcs.Bucket
+	for name, b := range s.buckets {
+		if project != "" && b.project != "" && b.project != project {
+			continue
+		}
+		if strings.HasPrefix(name, prefix) {
+			l = append(l, b.cloneAttrs())
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	return l
+}
+
+// immutableBucketFields is Patch で変更できない Bucket の項目
+var immutableBucketFields = []string{
+	"kind", "id", "selfLink", "name", "metageneration", "timeCreated", "updated", "etag",
+}
+
+// fillDerivedAttrs is Bucket 名と Metageneration から決まる Attrs を埋める
+func (b *bucketEntry) fillDerivedAttrs() {
+	a := b.attrs
+	a.Kind = "storage#bucket"
+	a.Id = a.Name
+	a.SelfLink = fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s", a.Name)
+	a.Etag = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", a.Metageneration)))
+	fillBucketACL(a)
+}
+
+// touch is Bucket の metadata を変更した時に Metageneration と更新時刻を進める
+func (b *bucketEntry) touch(now time.Time) {
+	b.attrs.Metageneration++
+	b.attrs.Updated = now.UTC().Format(time.RFC3339Nano)
+	b.fillDerivedAttrs()
+}
+
+func (b *bucketEntry) cloneAttrs() *apigcs.Bucket {
+	// 入れ子の項目が多いので JSON を経由して Copy する
+	var attrs apigcs.Bucket
+	if err := copyJSON(b.attrs, &attrs); err != nil {
+		panic(err)
+	}
+	attrs.Acl = toBucketACL(toObjectACL(b.attrs.Acl))
+	fillBucketACL(&attrs)
+	attrs.DefaultObjectAcl = cloneObjectACL(b.attrs.DefaultObjectAcl)
+	return &attrs
+}
+
+func (s *server) insertBucket(w http.ResponseWriter, r *http.Request, ar *apiRequest) {
+	var attrs apigcs.Bucket
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+		writeError(w, ar, errInvalid(err.Error()))
+		return
+	}
+	if v := ar.query.Get("predefinedAcl"); v != "" {
+		acl, err := predefinedBucketACL(v)
+		if err != nil {
+			writeError(w, ar, err)
+			return
+		}
+		attrs.Acl = acl
+	}
+	if v := ar.query.Get("predefinedDefaultObjectAcl"); v != "" {
+		acl, err := predefinedObjectACL(v)
+		if err != nil {
+			writeError(w, ar, err)
+			return
+		}
+		// Default Object ACL の owner は Object を作成した User になるので、ここでは含めない
+		acl, _ = deleteACLRule(acl, fakeOwnerEntity)
+		attrs.DefaultObjectAcl = acl
+	}
+	bucket, err := s.store.insertBucket(ar.query.Get("project"), &attrs)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bucket)
+}
+
+func (s *server) getBucket(w http.ResponseWriter, ar *apiRequest) {
+	bucket, err := s.store.getBucket(ar.bucket)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bucket)
+}
+
+func (s *server) patchBucket(w http.ResponseWriter, r *http.Request, ar *apiRequest, cond *conditions) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, ar, errInvalid(err.Error()))
+		return
+	}
+	bucket, err := s.store.patchBucket(ar.bucket, b, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bucket)
+}
+
+func (s *server) deleteBucket(w http.ResponseWriter, ar *apiRequest, cond *conditions) {
+	if err := s.store.deleteBucket(ar.bucket, cond); err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listBuckets is project の Bucket を prefix で絞り込んで、名前順に page に分けて返す
+// pageToken は前の page の最後の Bucket 名
+func (s *server) listBuckets(w http.ResponseWriter, ar *apiRequest) {
+	maxResults := defaultMaxResults
+	if v := ar.query.Get("maxResults"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, ar, errInvalid(fmt.Sprintf("Invalid value for maxResults: %s", v)))
+			return
+		}
+		if n > 0 && n < defaultMaxResults {
+			maxResults = n
+		}
+	}
+	pageToken := ar.query.Get("pageToken")
+	res := &apigcs.Buckets{Kind: "storage#buckets"}
+	for _, b := range s.store.listBuckets(ar.query.Get("project"), ar.query.Get("prefix")) {
+		if pageToken != "" && b.Name <= pageToken {
+			continue
+		}
+		if len(res.Items) == maxResults {
+			res.NextPageToken = res.Items[len(res.Items)-1].Name
+			break
+		}
+		res.Items = append(res.Items, b)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,184 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+func assertStatusCode(t *testing.T, err error, code int) {
+	t.Helper()
+
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		t.Fatalf("want googleapi.Error but got %v", err)
+	}
+	if e, g := code, gerr.Code; e != g {
+		t.Errorf("want status %d but got %d", e, g)
+	}
+}
+
+func TestStatefulFaker_BucketLifecycle(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake-bucket"
+	bkt := stg.Bucket(bucket)
+	err := bkt.Create(ctx, "sinmetal-ci", &storage.BucketAttrs{
+		Location:                 "asia-northeast1",
+		StorageClass:             "NEARLINE",
+		Labels:                   map[string]string{"env": "test", "team": "sinmetal"},
+		UniformBucketLevelAccess: storage.UniformBucketLevelAccess{Enabled: true},
+		CORS: []storage.CORS{
+			{MaxAge: time.Hour, Methods: []string{"GET"}, Origins: []string{"https://example.com"}, ResponseHeaders: []string{"Content-Type"}},
+		},
+		Website:         &storage.BucketWebsite{MainPageSuffix: "index.html", NotFoundPage: "404.html"},
+		RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatusCode(t, bkt.Create(ctx, "sinmetal-ci", nil), http.StatusConflict)
+
+	attrs, err := bkt.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "ASIA-NORTHEAST1", attrs.Location; e != g {
+		t.Errorf("want location %s but got %s", e, g)
+	}
+	if e, g := "region", attrs.LocationType; e != g {
+		t.Errorf("want locationType %s but got %s", e, g)
+	}
+	if e, g := "NEARLINE", attrs.StorageClass; e != g {
+		t.Errorf("want storageClass %s but got %s", e, g)
+	}
+	if e, g := map[string]string{"env": "test", "team": "sinmetal"}, attrs.Labels; !cmp.Equal(e, g) {
+		t.Errorf("unexpected labels %s", cmp.Diff(e, g))
+	}
+	if !attrs.UniformBucketLevelAccess.Enabled || attrs.UniformBucketLevelAccess.LockedTime.IsZero() {
+		t.Errorf("unexpected UniformBucketLevelAccess %+v", attrs.UniformBucketLevelAccess)
+	}
+	if e, g := 1, len(attrs.CORS); e != g {
+		t.Errorf("want %d CORS but got %d", e, g)
+	}
+	if attrs.Website == nil || attrs.Website.MainPageSuffix != "index.html" {
+		t.Errorf("unexpected website %+v", attrs.Website)
+	}
+	if attrs.RetentionPolicy == nil || attrs.RetentionPolicy.RetentionPeriod != time.Hour || attrs.RetentionPolicy.EffectiveTime.IsZero() {
+		t.Errorf("unexpected retentionPolicy %+v", attrs.RetentionPolicy)
+	}
+
+	uattrs := storage.BucketAttrsToUpdate{}
+	uattrs.SetLabel("env", "prod")
+	uattrs.DeleteLabel("team")
+	updated, err := bkt.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration}).Update(ctx, uattrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := map[string]string{"env": "prod"}, updated.Labels; !cmp.Equal(e, g) {
+		t.Errorf("unexpected labels %s", cmp.Diff(e, g))
+	}
+	if e, g := attrs.MetaGeneration+1, updated.MetaGeneration; e != g {
+		t.Errorf("want metageneration %d but got %d", e, g)
+	}
+	_, err = bkt.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration}).Update(ctx, uattrs)
+	assertStatusCode(t, err, http.StatusPreconditionFailed)
+
+	// Retention Policy があると Object を削除できないので外しておく
+	if _, err := bkt.Update(ctx, storage.BucketAttrsToUpdate{RetentionPolicy: &storage.RetentionPolicy{}}); err != nil {
+		t.Fatal(err)
+	}
+	writeObject(t, stg, bucket, "file.txt", "file")
+	assertStatusCode(t, bkt.Delete(ctx), http.StatusConflict)
+	if err := bkt.Object("file.txt").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := bkt.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bkt.Attrs(ctx); !errors.Is(err, storage.ErrBucketNotExist) {
+		t.Errorf("want ErrBucketNotExist but got %v", err)
+	}
+}
+
+func TestStatefulFaker_ListBuckets(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	for _, name := range []string{"sinmetal-c", "sinmetal-a", "other", "sinmetal-b"} {
+		if err := stg.Bucket(name).Create(ctx, "sinmetal-ci", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := stg.Buckets(ctx, "sinmetal-ci")
+	it.Prefix = "sinmetal-"
+	pager := iterator.NewPager(it, 2, "")
+	var got [][]string
+	for {
+		var page []*storage.BucketAttrs
+		token, err := pager.NextPage(&page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, b := range page {
+			names = append(names, b.Name)
+		}
+		got = append(got, names)
+		if token == "" {
+			break
+		}
+	}
+	if e := [][]string{{"sinmetal-a", "sinmetal-b"}, {"sinmetal-c"}}; !cmp.Equal(e, got) {
+		t.Errorf("unexpected pages %s", cmp.Diff(e, got))
+	}
+}
+
+func TestStatefulFaker_ListBucketsByProject(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	for project, names := range map[string][]string{
+		"sinmetal-ci":    {"sinmetal-ci-a", "sinmetal-ci-b"},
+		"sinmetal-other": {"sinmetal-other-a"},
+	} {
+		for _, name := range names {
+			if err := stg.Bucket(name).Create(ctx, project, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Object の書き込みで暗黙的に作成された Bucket は全ての Project に含まれる
+	writeObject(t, stg, "sinmetal-implicit", "hello.txt", "Hello")
+
+	for project, e := range map[string][]string{
+		"sinmetal-ci":    {"sinmetal-ci-a", "sinmetal-ci-b", "sinmetal-implicit"},
+		"sinmetal-other": {"sinmetal-implicit", "sinmetal-other-a"},
+		"sinmetal-none":  {"sinmetal-implicit"},
+	} {
+		var got []string
+		it := stg.Buckets(ctx, project)
+		for {
+			b, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, b.Name)
+		}
+		if !cmp.Equal(e, got) {
+			t.Errorf("%s : unexpected buckets %s", project, cmp.Diff(e, got))
+		}
+	}
+}
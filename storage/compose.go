@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// maxComposeSources is 1回の objects.compose で指定できる Object の数
+const maxComposeSources = 32
+
+// composeSource is objects.compose で結合する Object
+type composeSource struct {
+	name string
+	cond *conditions
+}
+
+// composeObject is 同じ Bucket の sources を順番に結合した Object を書き込む
+// 結合した Object は MD5 を持たず、CRC32C と componentCount を持つ
+func (s *store) composeObject(bucket string, dest *apigcs.Object, sources []*composeSource, cond *conditions) (*apigcs.Object, error) {
+	if dest.Name == "" {
+		return nil, errInvalid("Required object name is missing.")
+	}
+	if len(sources) == 0 {
+		return nil, errInvalid("The number of source components provided (0) is less than the minimum (1).")
+	}
+	if len(sources) > maxComposeSources {
+		return nil, errInvalid(fmt.Sprintf("The number of source components provided (%d) exceeds the maximum (%d).", len(sources), maxComposeSources))
+	}
+
+	blobs, componentCount, err := s.composeSources(bucket, dest.Name, sources, cond)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, blob := range blobs {
+			blob.drop()
+		}
+	}()
+
+	// 中身の結合は Lock を取らずに行うので、大きな Object の compose 中も他の操作はブロックしない
+	// Blob は書き込んだ後に変更されず、参照を持っている間は Release されないので、Lock の外で読んでも問題ない
+	raw, hash, err := concatBlobs(s.backend, blobs)
+	if err != nil {
+		return nil, err
+	}
+	blob := newStoredBlob(raw)
+	defer blob.drop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 結合している間に Bucket が削除されたり、結合先の Object が変わったりしているかもしれないので、もう一度確認する
+	if _, ok := s.buckets[bucket]; !ok {
+		return nil, errBucketNotFound()
+	}
+	obj, err := s.writeObject(bucket, dest, blob, hash, cond)
+	if err != nil {
+		return nil, err
+	}
+	obj.attrs.ComponentCount = componentCount
+	obj.attrs.Md5Hash = ""
+	return obj.clone().attrs, nil
+}
+
+// composeSources is sources の Precondition と結合先の Precondition を確認して、結合する Blob と componentCount を返す
+// 結合している間に sources が削除されても読めるように、返す Blob の参照を 1 つずつ持つので、呼び出し元は読み終わったら drop する
+func (s *store) composeSources(bucket string, object string, sources []*composeSource, cond *conditions) ([]*storedBlob, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var blobs []*storedBlob
+	var componentCount int64
+	for _, src := range sources {
+		o, err := s.lookupObject(bucket, src.name, src.cond)
+		if err != nil {
+			return nil, 0, err
+		}
+		blobs = append(blobs, o.blob)
+		if o.attrs.ComponentCount > 0 {
+			componentCount += o.attrs.ComponentCount
+		} else {
+			componentCount++
+		}
+	}
+	var current *apigcs.Object
+	if o, ok := s.buckets[bucket].objects[object]; ok {
+		current = o.attrs
+	}
+	if err := cond.check(current); err != nil {
+		return nil, 0, err
+	}
+	for _, blob := range blobs {
+		blob.retain()
+	}
+	return blobs, componentCount, nil
+}
+
+// concatBlobs is blobs の中身を順番に繋げて backend に書き込む
+func concatBlobs(backend Backend, blobs []*storedBlob) (Blob, *objectHash, error) {
+	var readers []io.Reader
+	for _, blob := range blobs {
+		r, err := blob.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	return writeBlob(backend, io.MultiReader(readers...))
+}
+
+func (s *server) composeObject(w http.ResponseWriter, r *http.Request, ar *apiRequest, cond *conditions) {
+	var req apigcs.ComposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ar, errInvalid(err.Error()))
+		return
+	}
+	dest := &apigcs.Object{}
+	if req.Destination != nil {
+		dest = req.Destination
+	}
+	dest.Name = ar.object
+	if err := applyPredefinedACL(dest, ar.query.Get("destinationPredefinedAcl")); err != nil {
+		writeError(w, ar, err)
+		return
+	}
+
+	var sources []*composeSource
+	for _, v := range req.SourceObjects {
+		src := &composeSource{name: v.Name, cond: &conditions{}}
+		if v.Generation != 0 {
+			g := v.Generation
+			src.cond.generation = &g
+		}
+		if v.ObjectPreconditions != nil && v.ObjectPreconditions.IfGenerationMatch != 0 {
+			g := v.ObjectPreconditions.IfGenerationMatch
+			src.cond.ifGenerationMatch = &g
+		}
+		sources = append(sources, src)
+	}
+
+	obj, err := s.store.composeObject(ar.bucket, dest, sources, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, applyProjection(obj, ar.query.Get("projection")))
+}
@@ -0,0 +1,117 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	apigcs "google.golang.org/api/storage/v1"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+// getRawObject is Client Library の ObjectAttrs に無い項目を確認するために JSON API の Object をそのまま取得する
+func getRawObject(t *testing.T, faker *storagefaker.Faker, bucket string, object string) *apigcs.Object {
+	t.Helper()
+
+	res, err := faker.Client.Get(fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s", bucket, url.PathEscape(object)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if e, g := http.StatusOK, res.StatusCode; e != g {
+		t.Fatalf("want status %d but got %d", e, g)
+	}
+	var obj apigcs.Object
+	if err := json.NewDecoder(res.Body).Decode(&obj); err != nil {
+		t.Fatal(err)
+	}
+	return &obj
+}
+
+func TestStatefulFaker_Compose(t *testing.T) {
+	ctx := context.Background()
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	bkt := stg.Bucket(bucket)
+	for _, name := range []string{"part-1", "part-2", "part-3"} {
+		writeObject(t, stg, bucket, name, name+";")
+	}
+
+	composer := bkt.Object("composed").ComposerFrom(bkt.Object("part-1"), bkt.Object("part-2"), bkt.Object("part-3"))
+	composer.ContentType = "text/plain"
+	attrs, err := composer.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "part-1;part-2;part-3;"
+	if e, g := want, readObject(t, stg, bucket, "composed"); e != g {
+		t.Errorf("want body %q but got %q", e, g)
+	}
+	if e, g := int64(3), getRawObject(t, faker, bucket, "composed").ComponentCount; e != g {
+		t.Errorf("want componentCount %d but got %d", e, g)
+	}
+	if e, g := crc32.Checksum([]byte(want), crc32.MakeTable(crc32.Castagnoli)), attrs.CRC32C; e != g {
+		t.Errorf("want crc32c %d but got %d", e, g)
+	}
+	if e, g := "text/plain", attrs.ContentType; e != g {
+		t.Errorf("want contentType %s but got %s", e, g)
+	}
+
+	// composite object を結合した場合は componentCount を合計する
+	if _, err := bkt.Object("composed-twice").ComposerFrom(bkt.Object("composed"), bkt.Object("part-1")).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int64(4), getRawObject(t, faker, bucket, "composed-twice").ComponentCount; e != g {
+		t.Errorf("want componentCount %d but got %d", e, g)
+	}
+
+	t.Run("too many sources", func(t *testing.T) {
+		var srcs []*storage.ObjectHandle
+		for i := 0; i < 33; i++ {
+			srcs = append(srcs, bkt.Object("part-1"))
+		}
+		_, err := bkt.Object("too-many").ComposerFrom(srcs...).Run(ctx)
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) {
+			t.Fatalf("want googleapi.Error but got %v", err)
+		}
+		if e, g := http.StatusBadRequest, gerr.Code; e != g {
+			t.Errorf("want status %d but got %d", e, g)
+		}
+	})
+
+	t.Run("source not found", func(t *testing.T) {
+		_, err := bkt.Object("missing").ComposerFrom(bkt.Object("part-1"), bkt.Object("not-found")).Run(ctx)
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) {
+			t.Fatalf("want googleapi.Error but got %v", err)
+		}
+		if e, g := http.StatusNotFound, gerr.Code; e != g {
+			t.Errorf("want status %d but got %d", e, g)
+		}
+	})
+
+	t.Run("source generation mismatch", func(t *testing.T) {
+		src := bkt.Object("part-1").If(storage.Conditions{GenerationMatch: 1})
+		_, err := bkt.Object("mismatch").ComposerFrom(src).Run(ctx)
+		assertPreconditionFailed(t, err)
+	})
+
+	t.Run("destination exists", func(t *testing.T) {
+		dst := bkt.Object("composed").If(storage.Conditions{DoesNotExist: true})
+		_, err := dst.ComposerFrom(bkt.Object("part-1")).Run(ctx)
+		assertPreconditionFailed(t, err)
+		if e, g := want, readObject(t, stg, bucket, "composed"); e != g {
+			t.Errorf("want body %q but got %q", e, g)
+		}
+	})
+}
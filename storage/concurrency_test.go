@@ -0,0 +1,159 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func TestFaker_ConcurrentAddAndGet(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+	const n = 50
+
+	faker := storagefaker.NewFaker(t)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			object := fmt.Sprintf("dir/%d.txt", i)
+			body := fmt.Sprintf("Hello %d", i)
+			if err := faker.AddGetObjectResponse(bucket, object, newTextResponse(body)); err != nil {
+				errs <- err
+				return
+			}
+			r, err := stg.Bucket(bucket).Object(object).NewReader(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(got) != body {
+				errs <- fmt.Errorf("want %q but got %q", body, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestFaker_ConcurrentGetSameKey(t *testing.T) {
+	const u = "https://storage.googleapis.com/sinmetal-ci-fake/dir/hello.txt"
+	const n = 50
+
+	faker := storagefaker.NewFaker(t)
+	for i := 0; i < n; i++ {
+		if err := faker.AddResponse(u, "GET", newTextResponse(fmt.Sprintf("%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var got []string
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := faker.Client.Get(u)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			got = append(got, string(b))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// 1つの登録は1回だけ返すので、全ての Response が重複せずに返る
+	sort.Strings(got)
+	if e, g := n, len(got); e != g {
+		t.Fatalf("want %d responses but got %d", e, g)
+	}
+	for i, v := range got {
+		if e := fmt.Sprintf("%03d", i); e != v {
+			t.Errorf("want %q but got %q", e, v)
+		}
+	}
+}
+
+func TestFaker_OrderPerKey(t *testing.T) {
+	const bucket = "sinmetal-ci-fake"
+
+	faker := storagefaker.NewFaker(t)
+	for _, object := range []string{"a.txt", "b.txt"} {
+		for i := 0; i < 3; i++ {
+			if err := faker.AddGetObjectResponse(bucket, object, newTextResponse(fmt.Sprintf("%s-%d", object, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 別の key の Request を挟んでも、key ごとに登録した順番で返す
+	for i := 0; i < 3; i++ {
+		for _, object := range []string{"b.txt", "a.txt"} {
+			u := fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, object)
+			if e, g := fmt.Sprintf("%s-%d", object, i), getBody(t, faker.Client, u); e != g {
+				t.Errorf("want %q but got %q", e, g)
+			}
+		}
+	}
+}
+
+func TestStatefulFaker_Parallel(t *testing.T) {
+	const bucket = "sinmetal-ci-fake"
+
+	_, stg := newStatefulClient(t)
+	if err := stg.Bucket(bucket).Create(context.Background(), "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			i := i
+			t.Run(fmt.Sprintf("object-%d", i), func(t *testing.T) {
+				t.Parallel()
+
+				object := fmt.Sprintf("dir/%d.txt", i)
+				body := fmt.Sprintf("Hello %d", i)
+				writeObject(t, stg, bucket, object, body)
+				if e, g := body, readObject(t, stg, bucket, object); e != g {
+					t.Errorf("want %q but got %q", e, g)
+				}
+			})
+		}
+	})
+}
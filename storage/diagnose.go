@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// maxNearMisses is 一致しなかった Request の報告に載せる、似ている登録の最大数
+const maxNearMisses = 5
+
+// UnmatchedRequestError is 登録された Response が無く、stateful mode の store でも処理できなかった Request の error
+//
+// HTTP の 501 Not Implemented に相当するが、Response として返すと Client Library が 5xx として Retry し続けるので、
+// Retry されない error として RoundTrip から返す
+type UnmatchedRequestError struct {
+	// StatusCode is 常に http.StatusNotImplemented
+	StatusCode int
+
+	// Report is Request の内容と、似ている登録を近い順に並べた報告
+	Report string
+}
+
+func (e *UnmatchedRequestError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Report)
+}
+
+// storeError is emulator mode などで HTTP の Response として返すための storeError にする
+// Client Library は 501 を含む 5xx と 408, 429 を Retry するので、Retry されない 400 として返す
+func (e *UnmatchedRequestError) storeError() *storeError {
+	return &storeError{
+		code:    http.StatusBadRequest,
+		reason:  "notImplemented",
+		message: e.Report,
+		xmlCode: "NotImplemented",
+	}
+}
+
+// nearMiss is Request に一致しなかった登録と、Request との違い
+type nearMiss struct {
+	registration *registration
+	diffs        []string
+}
+
+// unmatched is Request に一致する登録が無かった時の UnmatchedRequestError を作る
+func (f *fakeResponses) unmatched(req *http.Request, ar *apiRequest) *UnmatchedRequestError {
+	return &UnmatchedRequestError{
+		StatusCode: http.StatusNotImplemented,
+		Report:     f.diagnose(req, ar),
+	}
+}
+
+// diagnose is Request の Method, 解釈した操作, Bucket, Object と、似ている登録を近い順に並べた報告を作る
+// 違いが少ない登録ほど近いとして、違いが同じ数の場合は登録順に並べる
+func (f *fakeResponses) diagnose(req *http.Request, ar *apiRequest) string {
+	key := newRouteKey(req, ar)
+
+	f.mu.Lock()
+	var misses []nearMiss
+	matchers := 0
+	for _, r := range f.registrations {
+		if r.matcher != nil {
+			matchers++
+			continue
+		}
+		misses = append(misses, nearMiss{registration: r, diffs: r.diff(key, req.URL.Query())})
+	}
+	f.mu.Unlock()
+
+	sort.SliceStable(misses, func(i, j int) bool {
+		return len(misses[i].diffs) < len(misses[j].diffs)
+	})
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "no response is registered for %s %s\n", req.Method, req.URL.String())
+	if ar.operation == operationUnknown {
+		sb.WriteString("  operation: unknown\n")
+	} else {
+		fmt.Fprintf(&sb, "  operation: %s\n", ar.operation)
+		fmt.Fprintf(&sb, "  bucket: %q\n", ar.bucket)
+		fmt.Fprintf(&sb, "  object: %q\n", ar.object)
+	}
+	if len(misses) == 0 {
+		sb.WriteString("  no responses are registered")
+	} else {
+		sb.WriteString("  registered responses (closest first):")
+		for i, m := range misses {
+			if i == maxNearMisses {
+				fmt.Fprintf(&sb, "\n    ... and %d more", len(misses)-maxNearMisses)
+				break
+			}
+			fmt.Fprintf(&sb, "\n    %d. %s", i+1, m.registration.key)
+			for _, d := range m.diffs {
+				fmt.Fprintf(&sb, "\n       - %s", d)
+			}
+		}
+	}
+	if matchers > 0 {
+		fmt.Fprintf(&sb, "\n  %d matcher registrations did not match", matchers)
+	}
+	return sb.String()
+}
+
+// diff is 登録した key と Request の key の違いを、人が読める文で返す
+// query は Request の Query Parameter で、登録した URL に Query Parameter があればそれと比べる
+func (r *registration) diff(req routeKey, query url.Values) []string {
+	k := r.key
+	var diffs []string
+	differs := func(name string, registered string, requested string) {
+		if registered != requested {
+			diffs = append(diffs, fmt.Sprintf("%s differs (registered %q, request %q)", name, registered, requested))
+		}
+	}
+	differs("operation", string(k.operation), string(req.operation))
+	if k.operation == operationUnknown || req.operation == operationUnknown {
+		differs("method", k.method, req.method)
+		differs("path", k.path, req.path)
+	}
+	differs("bucket", k.bucket, req.bucket)
+	differs("object", k.object, req.object)
+	differs("acl", string(k.acl), string(req.acl))
+	differs("entity", k.entity, req.entity)
+	differs("destination bucket", k.destinationBucket, req.destinationBucket)
+	differs("destination object", k.destinationObject, req.destinationObject)
+	if k.generation != "" {
+		differs("generation", k.generation, req.generation)
+	}
+	if k.resumable != req.resumable {
+		if k.resumable {
+			diffs = append(diffs, "registered for the start of a resumable upload session, but request is not")
+		} else {
+			diffs = append(diffs, "request starts a resumable upload session, but registered response is not for it")
+		}
+	}
+	return append(diffs, r.diffQuery(query)...)
+}
+
+// diffQuery is 登録した URL の Query Parameter と Request の Query Parameter の違いを返す
+// GCS の操作として解釈できない URL では全ての Query Parameter を比べるが、
+// それ以外では登録した URL にある Query Parameter だけを比べる
+func (r *registration) diffQuery(query url.Values) []string {
+	registered := r.query
+	all := false
+	if r.key.operation == operationUnknown {
+		registered, _ = url.ParseQuery(r.key.query)
+		all = true
+	}
+	names := make(map[string]bool)
+	for name := range registered {
+		names[name] = true
+	}
+	if all {
+		for name := range query {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, name := range sorted {
+		rv, rok := registered[name]
+		qv, qok := query[name]
+		switch {
+		case !qok:
+			diffs = append(diffs, fmt.Sprintf("query param %s is missing in request (registered %q)", name, strings.Join(rv, ",")))
+		case !rok:
+			diffs = append(diffs, fmt.Sprintf("query param %s is not in registered url (request %q)", name, strings.Join(qv, ",")))
+		case strings.Join(rv, ",") != strings.Join(qv, ","):
+			diffs = append(diffs, fmt.Sprintf("query param %s differs (registered %q, request %q)", name, strings.Join(rv, ","), strings.Join(qv, ",")))
+		}
+	}
+	return diffs
+}
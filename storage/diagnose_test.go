@@ -0,0 +1,85 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func TestUnmatchedRequestError_NearMisses(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+
+	faker := storagefaker.NewFakerWithoutTesting()
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AddGetObjectResponse("other-bucket", "other.txt", newTextResponse("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AddGetObjectResponse(bucket, "dir/hello.txt", newTextResponse("Hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stg.Bucket(bucket).Object("dir/world.txt").NewReader(ctx)
+	var unmatched *storagefaker.UnmatchedRequestError
+	if !errors.As(err, &unmatched) {
+		t.Fatalf("want UnmatchedRequestError but got %v", err)
+	}
+	if e, g := http.StatusNotImplemented, unmatched.StatusCode; e != g {
+		t.Errorf("want status %d but got %d", e, g)
+	}
+	for _, want := range []string{
+		`operation: objects.download`,
+		`bucket: "sinmetal-ci-fake"`,
+		`object: "dir/world.txt"`,
+		`object differs (registered "dir/hello.txt", request "dir/world.txt")`,
+	} {
+		if !strings.Contains(unmatched.Report, want) {
+			t.Errorf("report does not contain %q\n%s", want, unmatched.Report)
+		}
+	}
+	// 違いが少ない登録を先に並べる
+	near := strings.Index(unmatched.Report, `"dir/hello.txt"`)
+	far := strings.Index(unmatched.Report, `"other.txt"`)
+	if near < 0 || far < 0 || near > far {
+		t.Errorf("want closest registration first\n%s", unmatched.Report)
+	}
+}
+
+func TestUnmatchedRequestError_QueryParamDiffers(t *testing.T) {
+	faker := storagefaker.NewFakerWithoutTesting()
+	if err := faker.AddResponse("https://example.com/custom?projection=noAcl", http.MethodGet, newTextResponse("custom")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := faker.Client.Get("https://example.com/custom?projection=full")
+	var unmatched *storagefaker.UnmatchedRequestError
+	if !errors.As(err, &unmatched) {
+		t.Fatalf("want UnmatchedRequestError but got %v", err)
+	}
+	if want := `query param projection differs (registered "noAcl", request "full")`; !strings.Contains(unmatched.Report, want) {
+		t.Errorf("report does not contain %q\n%s", want, unmatched.Report)
+	}
+}
+
+func TestUnmatchedRequestError_NoRegistrations(t *testing.T) {
+	faker := storagefaker.NewFakerWithoutTesting()
+
+	_, err := faker.Client.Get("https://storage.googleapis.com/sinmetal-ci-fake/hello.txt")
+	var unmatched *storagefaker.UnmatchedRequestError
+	if !errors.As(err, &unmatched) {
+		t.Fatalf("want UnmatchedRequestError but got %v", err)
+	}
+	if want := "no responses are registered"; !strings.Contains(unmatched.Report, want) {
+		t.Errorf("report does not contain %q\n%s", want, unmatched.Report)
+	}
+}
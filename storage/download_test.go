@@ -0,0 +1,124 @@
+package storage_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func newTextResponse(body string) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func getBody(t *testing.T, client *http.Client, u string) string {
+	t.Helper()
+
+	res, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := http.StatusOK, res.StatusCode; e != g {
+		t.Fatalf("want status %d but got %d. %s", e, g, b)
+	}
+	return string(b)
+}
+
+func TestAddGetObjectResponse_URLShapes(t *testing.T) {
+	const bucket = "sinmetal-ci-fake"
+	const object = "dir/日本語 file.txt"
+	escaped := url.PathEscape(object)
+
+	cases := []struct {
+		name string
+		url  string
+	}{
+		{"XML", "https://storage.googleapis.com/" + bucket + "/dir/" + url.PathEscape("日本語 file.txt")},
+		{"XML with generation and userProject", "https://storage.googleapis.com/" + bucket + "/dir/" + url.PathEscape("日本語 file.txt") + "?generation=1&userProject=sinmetal-ci"},
+		{"JSON alt=media", "https://storage.googleapis.com/storage/v1/b/" + bucket + "/o/" + escaped + "?alt=media"},
+		{"MediaLink", "https://storage.googleapis.com/download/storage/v1/b/" + bucket + "/o/" + escaped + "?generation=1&alt=media&userProject=sinmetal-ci"},
+		{"www.googleapis.com", "https://www.googleapis.com/download/storage/v1/b/" + bucket + "/o/" + escaped + "?alt=media"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			faker := storagefaker.NewFaker(t)
+			if err := faker.AddGetObjectResponse(bucket, object, newTextResponse("Hello")); err != nil {
+				t.Fatal(err)
+			}
+			if e, g := "Hello", getBody(t, faker.Client, tt.url); e != g {
+				t.Errorf("want %q but got %q", e, g)
+			}
+		})
+	}
+}
+
+func TestAddGetObjectGenerationResponse(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+	const object = "dir/versioned.txt"
+
+	faker := storagefaker.NewFaker(t)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AddGetObjectResponse(bucket, object, newTextResponse("latest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AddGetObjectGenerationResponse(bucket, object, 100, newTextResponse("generation 100")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := stg.Bucket(bucket).Object(object).Generation(100).NewReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "generation 100", string(got); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	if e, g := "latest", readObject(t, stg, bucket, object); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+}
+
+func TestStatefulFaker_DownloadURLShapes(t *testing.T) {
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "dir/日本語 file.txt"
+	attrs := writeObject(t, stg, bucket, object, "Hello")
+	escaped := url.PathEscape(object)
+
+	for _, u := range []string{
+		attrs.MediaLink,
+		"https://storage.googleapis.com/storage/v1/b/" + bucket + "/o/" + escaped + "?alt=media&userProject=sinmetal-ci",
+		"https://storage.googleapis.com/" + bucket + "/dir/" + url.PathEscape("日本語 file.txt") + "?userProject=sinmetal-ci",
+	} {
+		if e, g := "Hello", getBody(t, faker.Client, u); e != g {
+			t.Errorf("%s : want %q but got %q", u, e, g)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gcsBaseURL is Faker が Request を処理する時の GCS の URL
+// 登録された Response の URL と比べられるように、Server に来た Request はこの URL への Request として扱う
+const gcsBaseURL = "https://storage.googleapis.com"
+
+// EmulatorServer is Faker を STORAGE_EMULATOR_HOST で使える HTTP Server として起動したもの
+//
+// option.WithHTTPClient で Faker.Client を渡せない場合でも、STORAGE_EMULATOR_HOST に Host を設定すれば
+// storage.NewClient で作った Client や、別 Process の Tool から JSON API と XML API を使える
+// 登録された Response が無い Request を処理できるように、NewStatefulFaker で作った Faker を使う
+type EmulatorServer struct {
+	*httptest.Server
+
+	faker *Faker
+}
+
+// NewEmulatorServer is faker で Request を処理する EmulatorServer を空いている Port で起動する
+// Server は t.Cleanup で閉じる
+func NewEmulatorServer(t *testing.T, faker *Faker) *EmulatorServer {
+	t.Helper()
+
+	s := NewEmulatorServerWithoutTesting(faker)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// NewEmulatorServerWithoutTesting is testing.T を使わずに NewEmulatorServer と同じ Server を起動する
+// 使い終わったら Close を呼ぶ
+func NewEmulatorServerWithoutTesting(faker *Faker) *EmulatorServer {
+	s := &EmulatorServer{faker: faker}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// StartEmulatorServer is faker で Request を処理する EmulatorServer を addr で起動する
+// "localhost:9000" のように固定の Port を使いたい場合に使う
+// 使い終わったら Close を呼ぶ
+func StartEmulatorServer(faker *Faker, addr string) (*EmulatorServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &EmulatorServer{faker: faker}
+	s.Server = httptest.NewUnstartedServer(s)
+	s.Server.Listener.Close()
+	s.Server.Listener = l
+	s.Server.Start()
+	return s, nil
+}
+
+// Host is STORAGE_EMULATOR_HOST に設定する Server の Host を返す
+func (s *EmulatorServer) Host() string {
+	return s.Listener.Addr().String()
+}
+
+func (s *EmulatorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.faker.serveHTTP(w, r)
+}
+
+// serveHTTP is Server に来た Request を GCS への Request として Transport で処理する
+// Response の Location Header は、Resumable Upload の chunk が Server に送られるように Server の URL に戻す
+func (faker *Faker) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.URL.Scheme = "https"
+	req.URL.Host = strings.TrimPrefix(gcsBaseURL, "https://")
+	req.Host = req.URL.Host
+	res, err := faker.transport.RoundTrip(req)
+	if err != nil {
+		ar := parseRequest(r)
+		writeError(w, ar, err)
+		return
+	}
+	defer res.Body.Close()
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	if v := res.Header.Get("Location"); strings.HasPrefix(v, gcsBaseURL) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		w.Header().Set("Location", scheme+"://"+r.Host+strings.TrimPrefix(v, gcsBaseURL))
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
@@ -0,0 +1,149 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func newEmulatorClient(t *testing.T, host string) *storage.Client {
+	t.Helper()
+
+	t.Setenv("STORAGE_EMULATOR_HOST", host)
+	stg, err := storage.NewClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = stg.Close()
+	})
+	return stg
+}
+
+func TestEmulatorServer(t *testing.T) {
+	ctx := context.Background()
+	srv := storagefaker.NewEmulatorServer(t, storagefaker.NewStatefulFaker(t))
+	stg := newEmulatorClient(t, srv.Host())
+
+	const bucket = "sinmetal-ci-fake"
+	writeObject(t, stg, bucket, "dir/small.txt", "small")
+
+	// ChunkSize より大きい Object は Resumable Upload になり、chunk は Location の Server に送られる
+	large := bytes.Repeat([]byte("0123456789"), 60*1024)
+	w := stg.Bucket(bucket).Object("dir/large.bin").NewWriter(ctx)
+	w.ChunkSize = 256 * 1024
+	if _, err := w.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, g := "small", readObject(t, stg, bucket, "dir/small.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	r, err := stg.Bucket(bucket).Object("dir/large.bin").NewReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(large, got) {
+		t.Errorf("want %d bytes but got %d bytes", len(large), len(got))
+	}
+
+	var names []string
+	it := stg.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: "dir/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, attrs.Name)
+	}
+	if e, g := 2, len(names); e != g {
+		t.Errorf("want %d objects but got %v", e, names)
+	}
+
+	if err := stg.Bucket(bucket).Object("dir/small.txt").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stg.Bucket(bucket).Object("dir/small.txt").NewReader(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("want ErrObjectNotExist but got %v", err)
+	}
+}
+
+func TestEmulatorServer_UnmatchedRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Request が一致しないことを t.Errorf で報告しないように、testing.T を渡さずに作成する
+	faker := storagefaker.NewFakerWithoutTesting()
+	if err := faker.AddGetObjectResponse("sinmetal-ci-fake", "hello.txt", storagefaker.GetObjectOKResponseSample()); err != nil {
+		t.Fatal(err)
+	}
+	srv := storagefaker.NewEmulatorServer(t, faker)
+	stg := newEmulatorClient(t, srv.Host())
+
+	obj := stg.Bucket("sinmetal-ci-fake").Object("other.txt")
+	_, err := obj.NewReader(ctx)
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		t.Fatalf("want googleapi.Error but got %v", err)
+	}
+	if e, g := http.StatusBadRequest, gerr.Code; e != g {
+		t.Errorf("want status %d but got %d", e, g)
+	}
+	if !strings.Contains(gerr.Body, "NotImplemented") || !strings.Contains(gerr.Body, "hello.txt") {
+		t.Errorf("want near-miss report in body but got %q", gerr.Body)
+	}
+
+	_, err = obj.Attrs(ctx)
+	if !errors.As(err, &gerr) {
+		t.Fatalf("want googleapi.Error but got %v", err)
+	}
+	if e, g := http.StatusBadRequest, gerr.Code; e != g {
+		t.Errorf("want status %d but got %d", e, g)
+	}
+	if !strings.Contains(gerr.Message, "hello.txt") {
+		t.Errorf("want near-miss report in message but got %q", gerr.Message)
+	}
+	if e, g := "notImplemented", gerr.Errors[0].Reason; e != g {
+		t.Errorf("want reason %q but got %q", e, g)
+	}
+	// Retry されないので、Request はそれぞれ 1 回だけ
+	if e, g := 2, len(faker.Requests()); e != g {
+		t.Errorf("want %d requests but got %d", e, g)
+	}
+}
+
+func TestStartEmulatorServer(t *testing.T) {
+	srv, err := storagefaker.StartEmulatorServer(storagefaker.NewStatefulFaker(t), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	stg := newEmulatorClient(t, srv.Host())
+
+	writeObject(t, stg, "sinmetal-ci-fake", "hello.txt", "Hello Emulator")
+	if e, g := "Hello Emulator", readObject(t, stg, "sinmetal-ci-fake", "hello.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+}
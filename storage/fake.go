@@ -5,8 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -23,12 +23,52 @@ type Faker struct {
 func NewFaker(t *testing.T) *Faker {
 	t.Helper()
 
+	return newFaker(t, nil)
+}
+
+func NewFakerWithoutTesting() *Faker {
+	return newFaker(nil, nil)
+}
+
+// NewStatefulFaker is in-memory な GCS を持つ Faker を作成する
+// 登録された Response が無い Request は in-memory な GCS で処理するので、
+// NewWriter で書き込んだ Object を Response を登録せずに NewReader で読み込むことができる
+func NewStatefulFaker(t *testing.T) *Faker {
+	t.Helper()
+
+	return newFaker(t, newServer(newStore(NewMemoryBackend())))
+}
+
+// NewStatefulFakerWithoutTesting is testing.T を使わずに NewStatefulFaker と同じ Faker を作成する
+func NewStatefulFakerWithoutTesting() *Faker {
+	return newFaker(nil, newServer(newStore(NewMemoryBackend())))
+}
+
+// NewStatefulFakerWithBackend is Object の中身を backend に保存する stateful mode の Faker を作成する
+// NewTempDirBackend を使うと、大きな Object の Upload や Download を memory に載せずに処理できる
+// Resumable Upload の途中の chunk も backend に書き込む
+func NewStatefulFakerWithBackend(t *testing.T, backend Backend) *Faker {
+	t.Helper()
+
+	return newFaker(t, newServer(newStore(backend)))
+}
+
+// NewStatefulFakerWithBackendWithoutTesting is testing.T を使わずに NewStatefulFakerWithBackend と同じ Faker を作成する
+func NewStatefulFakerWithBackendWithoutTesting(backend Backend) *Faker {
+	return newFaker(nil, newServer(newStore(backend)))
+}
+
+func newFaker(t *testing.T, server *server) *Faker {
+	var backend Backend = NewMemoryBackend()
+	if server != nil {
+		backend = server.store.backend
+	}
 	transport := &Transport{
-		t: t,
-		fakeResponses: &fakeResponses{
-			responseMap:     make(map[string]*http.Response),
-			requestCountMap: make(map[string]int),
-		},
+		t:             t,
+		fakeResponses: &fakeResponses{},
+		recorder:      newRecorder(),
+		uploads:       newResumableUploads(backend),
+		server:        server,
 	}
 	return &Faker{
 		transport: transport,
@@ -38,44 +78,102 @@ func NewFaker(t *testing.T) *Faker {
 	}
 }
 
-func NewFakerWithoutTesting() *Faker {
-	transport := &Transport{
-		fakeResponses: &fakeResponses{
-			responseMap:     make(map[string]*http.Response),
-			requestCountMap: make(map[string]int),
-		},
+// AdvanceTime is stateful mode の仮想的な時刻を d だけ進めて、Bucket の Lifecycle の rule を Object に適用する
+// Object の作成時刻などはこの仮想的な時刻を使うので、Age などの条件を時間を待たずに確認できる
+func (faker *Faker) AdvanceTime(d time.Duration) error {
+	st, err := faker.statefulStore("AdvanceTime")
+	if err != nil {
+		return err
 	}
-	return &Faker{
-		transport: transport,
-		Client: &http.Client{
-			Transport: transport,
-		},
+	st.advanceTime(d)
+	return nil
+}
+
+// now is Faker の現在時刻を返す
+// stateful mode の時は AdvanceTime で進めた仮想的な時刻になる
+func (faker *Faker) now() time.Time {
+	if faker.transport.server == nil {
+		return time.Now()
 	}
+	return faker.transport.server.store.currentTime()
 }
 
 // AddResponse is RequestされたURLに対するResponseを登録する
 // 同じURLを複数回呼ぶ時は複数回Addする
+// URL は GCS の操作として解釈して比べるので、Query Parameter の順番や操作に関係しない Query Parameter は見ない
 func (faker *Faker) AddResponse(url string, method string, response *http.Response) error {
-	faker.transport.fakeResponses.Add(url, method, response)
+	builder, err := responseBuilderOf(response)
+	if err != nil {
+		return err
+	}
+	return faker.transport.fakeResponses.Add(url, method, builder, false)
+}
+
+// AddResponseBuilder is RequestされたURLに対して、builder で作った Response を1回だけ返すように登録する
+// 同じURLを複数回呼ぶ時は複数回Addする
+func (faker *Faker) AddResponseBuilder(url string, method string, builder ResponseBuilder) error {
+	return faker.transport.fakeResponses.Add(url, method, builder, false)
+}
+
+// AlwaysRespond is RequestされたURLに対して、何回 Request されても builder で作った Response を返すように登録する
+// 1回だけ返す Response も登録されている場合は、そちらを先に返す
+func (faker *Faker) AlwaysRespond(url string, method string, builder ResponseBuilder) error {
+	return faker.transport.fakeResponses.Add(url, method, builder, true)
+}
+
+// AddResponseWithMatcher is matcher が true を返す Request に対する Response を登録する
+// URL で登録した Response よりも優先し、複数の matcher が一致する場合は先に登録したものを返す
+func (faker *Faker) AddResponseWithMatcher(matcher RequestMatcher, response *http.Response) error {
+	builder, err := responseBuilderOf(response)
+	if err != nil {
+		return err
+	}
+	faker.transport.fakeResponses.AddMatcher(matcher, builder, false)
+	return nil
+}
+
+// AlwaysRespondWithMatcher is matcher が true を返す全ての Request に、builder で作った Response を返すように登録する
+func (faker *Faker) AlwaysRespondWithMatcher(matcher RequestMatcher, builder ResponseBuilder) error {
+	faker.transport.fakeResponses.AddMatcher(matcher, builder, true)
+	return nil
+}
+
+// addKey is key に一致する Request に1回だけ response を返すように登録する
+func (faker *Faker) addKey(key routeKey, response *http.Response) error {
+	builder, err := responseBuilderOf(response)
+	if err != nil {
+		return err
+	}
+	faker.transport.fakeResponses.AddKey(key, builder, false)
 	return nil
 }
 
 // AddGetObjectResponse is 指定したobjectの読み込みに対してのResponseを登録する
 // 同じObjectを複数回読み込む時は複数回Addする
+// XML API, JSON API の alt=media, MediaLink のどの URL で読み込んでも、登録した Response を返す
+// generation と userProject の Query Parameter は見ない
 func (faker *Faker) AddGetObjectResponse(bucket string, object string, response *http.Response) error {
-	faker.transport.fakeResponses.Add(fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, object), http.MethodGet, response)
-	return nil
+	return faker.addKey(routeKey{operation: operationDownloadObject, bucket: bucket, object: object}, response)
+}
+
+// AddGetObjectGenerationResponse is 指定した Generation の object の読み込みに対しての Response を登録する
+// generation を指定した読み込みでは、AddGetObjectResponse で登録した Response よりも優先する
+func (faker *Faker) AddGetObjectGenerationResponse(bucket string, object string, generation int64, response *http.Response) error {
+	return faker.addKey(routeKey{operation: operationDownloadObject, bucket: bucket, object: object, generation: strconv.FormatInt(generation, 10)}, response)
 }
 
 // GenerateSimplePostObjectOKResponse is 最低限指定したそうな場所だけ指定すれば残りは適当に埋めたOKResponseを返す
+// Generation は GCS と同じように現在時刻の micro second を使う
+// Md5Hash と Crc32c は空にしておき、Upload された時に中身から計算して Response に埋める
 func GenerateSimplePostObjectOKResponse(bucket string, object string, contentType string, size uint64) *apigcs.Object {
+	generation := time.Now().UnixMicro()
 	return &apigcs.Object{
 		Kind:                    "storage#object",
-		Id:                      fmt.Sprintf("%s/%s/1570087904014021", bucket, object),
+		Id:                      fmt.Sprintf("%s/%s/%d", bucket, object, generation),
 		SelfLink:                fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s", bucket, object),
 		Name:                    object,
 		Bucket:                  bucket,
-		Generation:              1570087904014021,
+		Generation:              generation,
 		Metageneration:          1,
 		ContentType:             contentType,
 		TimeCreated:             time.Now().String(),
@@ -83,16 +181,15 @@ func GenerateSimplePostObjectOKResponse(bucket string, object string, contentTyp
 		StorageClass:            "REGIONAL",
 		TimeStorageClassUpdated: time.Now().String(),
 		Size:                    size,
-		Md5Hash:                 "3fv0VXHjk3nCc3znVNrcRw==",
-		MediaLink:               fmt.Sprintf("https://www.googleapis.com/download/storage/v1/b/%s/o/%s?generation=1570087904014021&alt=media", bucket, object),
+		MediaLink:               fmt.Sprintf("https://www.googleapis.com/download/storage/v1/b/%s/o/%s?generation=%d&alt=media", bucket, object, generation),
 		Acl: []*apigcs.ObjectAccessControl{
 			{
 				Kind:       "storage#objectAccessControl",
-				Id:         fmt.Sprintf("%s/%s/1570087904014021/project-owners-168610916801", bucket, object),
+				Id:         fmt.Sprintf("%s/%s/%d/project-owners-168610916801", bucket, object, generation),
 				SelfLink:   fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s/acl/project-owners-168610916801", bucket, object),
 				Bucket:     bucket,
 				Object:     object,
-				Generation: 1570087904014021,
+				Generation: generation,
 				Entity:     "project-owners-168610916801",
 				Role:       "OWNER",
 				ProjectTeam: &apigcs.ObjectAccessControlProjectTeam{
@@ -104,11 +201,11 @@ func GenerateSimplePostObjectOKResponse(bucket string, object string, contentTyp
 			},
 			{
 				Kind:       "storage#objectAccessControl",
-				Id:         fmt.Sprintf("%s/%s/1570087904014021/project-owners-168610916801", bucket, object),
+				Id:         fmt.Sprintf("%s/%s/%d/project-owners-168610916801", bucket, object, generation),
 				SelfLink:   fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s/acl/project-owners-168610916801", bucket, object),
 				Bucket:     bucket,
 				Object:     object,
-				Generation: 1570087904014021,
+				Generation: generation,
 				Entity:     "project-owners-168610916801",
 				Role:       "OWNER",
 				Etag:       "CMXdo57J/+QCEAE=",
@@ -118,8 +215,7 @@ func GenerateSimplePostObjectOKResponse(bucket string, object string, contentTyp
 		Owner: &apigcs.ObjectOwner{
 			Entity: "user-faker@example.com",
 		},
-		Crc32c: "vOMu5Q==",
-		Etag:   "CMXdo57J/+QCEAE=",
+		Etag: "CMXdo57J/+QCEAE=",
 	}
 }
 
@@ -136,7 +232,13 @@ func (faker *Faker) AddPostObjectOKResponse(bucket string, object string, header
 		Body:          r,
 		ContentLength: int64(len(body)),
 	}
-	return faker.AddResponse(fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?alt=json&name=%s&prettyPrint=false&projection=full&uploadType=multipart", bucket, object), http.MethodPost, res)
+	return faker.addKey(insertObjectKey(bucket, object), res)
+}
+
+// insertObjectKey is Object の書き込みの Response を登録する key
+// uploadType=resumable で書き込んだ時も、最後の chunk に対してこの key で登録された Response を返す
+func insertObjectKey(bucket string, object string) routeKey {
+	return routeKey{operation: operationInsertObject, bucket: bucket, object: object}
 }
 
 func GenerateSimpleListObjectACLOKResponse(bucket string, object string, rules []storage.ACLRule) (*http.Response, error) {
@@ -159,12 +261,14 @@ func GenerateSimpleListObjectACLOKResponse(bucket string, object string, rules [
 			Role:       string(rule.Role),
 			SelfLink:   fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s/acl/%s", bucket, object, rule.Entity),
 		}
-		// TODO ProjectTeamはrule.Entityがproject-owners-{},project-editors-{},project-viewers-{}のいずれかの時に連動して入るようにした方が親切かもしれない
+		// ProjectTeamを指定していない時は、rule.Entityがproject-owners-{},project-editors-{},project-viewers-{}のいずれかであれば連動して入れる
 		if rule.ProjectTeam != nil {
 			item.ProjectTeam = &apigcs.ObjectAccessControlProjectTeam{
 				ProjectNumber: rule.ProjectTeam.ProjectNumber,
 				Team:          rule.ProjectTeam.Team,
 			}
+		} else {
+			item.ProjectTeam = projectTeamOf(string(rule.Entity))
 		}
 		items = append(items, item)
 	}
@@ -191,8 +295,7 @@ func GenerateSimpleListObjectACLOKResponse(bucket string, object string, rules [
 // AddListObjectACLResponse is 指定したobjectのACLListの取得に対してのResponseを登録する
 // 同じ操作を複数回実行する時は複数回Addする
 func (faker *Faker) AddListObjectACLResponse(bucket string, object string, response *http.Response) error {
-	faker.transport.fakeResponses.Add(fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s/acl?alt=json&prettyPrint=false", bucket, object), http.MethodGet, response)
-	return nil
+	return faker.addKey(listObjectACLKey(bucket, object), response)
 }
 
 // AddListObjectACLOKResponse is 指定したobjectのACLListの取得に対してのResponseを登録する
@@ -202,21 +305,27 @@ func (faker *Faker) AddListObjectACLOKResponse(bucket string, object string, rul
 	if err != nil {
 		return err
 	}
-	faker.transport.fakeResponses.Add(fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s/acl?alt=json&prettyPrint=false", bucket, object), http.MethodGet, res)
-	return nil
+	return faker.addKey(listObjectACLKey(bucket, object), res)
+}
+
+// listObjectACLKey is Object の ACL の一覧の取得の Response を登録する key
+func listObjectACLKey(bucket string, object string) routeKey {
+	return routeKey{operation: operation(fmt.Sprintf("%s.list", aclResourceObject)), bucket: bucket, object: object, acl: aclResourceObject}
 }
 
 // GenerateSimpleUpdateObjectAttrsOKResponse is 更新したObjectの結果のAttrsの情報は気にせず、validなものがあれば良い時に使える
+// Objectの中身は分からないので、Md5Hash と Crc32c は空にしている
 func GenerateSimpleUpdateObjectAttrsOKResponse(bucket string, object string) (*http.Response, error) {
 	header := map[string][]string{}
 	header["Content-Type"] = []string{"application/json; charset=UTF-8"}
+	generation := time.Now().UnixMicro()
 	obj := &apigcs.Object{
 		Kind:                    "storage#object",
-		Id:                      fmt.Sprintf("%s/%s/1570087904014021", bucket, object),
+		Id:                      fmt.Sprintf("%s/%s/%d", bucket, object, generation),
 		SelfLink:                fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s", bucket, object),
 		Name:                    object,
 		Bucket:                  bucket,
-		Generation:              1570087904014021,
+		Generation:              generation,
 		Metageneration:          1,
 		ContentType:             "text/plain; charset=utf-8",
 		TimeCreated:             time.Now().String(),
@@ -224,16 +333,15 @@ func GenerateSimpleUpdateObjectAttrsOKResponse(bucket string, object string) (*h
 		StorageClass:            "REGIONAL",
 		TimeStorageClassUpdated: time.Now().String(),
 		Size:                    1,
-		Md5Hash:                 "3fv0VXHjk3nCc3znVNrcRw==",
-		MediaLink:               fmt.Sprintf("https://www.googleapis.com/download/storage/v1/b/%s/o/%s?generation=1570087904014021&alt=media", bucket, object),
+		MediaLink:               fmt.Sprintf("https://www.googleapis.com/download/storage/v1/b/%s/o/%s?generation=%d&alt=media", bucket, object, generation),
 		Acl: []*apigcs.ObjectAccessControl{
 			{
 				Kind:       "storage#objectAccessControl",
-				Id:         fmt.Sprintf("%s/%s/1570087904014021/project-owners-168610916801", bucket, object),
+				Id:         fmt.Sprintf("%s/%s/%d/project-owners-168610916801", bucket, object, generation),
 				SelfLink:   fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s/acl/project-owners-168610916801", bucket, object),
 				Bucket:     bucket,
 				Object:     object,
-				Generation: 1570087904014021,
+				Generation: generation,
 				Entity:     "project-owners-168610916801",
 				Role:       "OWNER",
 				ProjectTeam: &apigcs.ObjectAccessControlProjectTeam{
@@ -245,11 +353,11 @@ func GenerateSimpleUpdateObjectAttrsOKResponse(bucket string, object string) (*h
 			},
 			{
 				Kind:       "storage#objectAccessControl",
-				Id:         fmt.Sprintf("%s/%s/1570087904014021/project-owners-168610916801", bucket, object),
+				Id:         fmt.Sprintf("%s/%s/%d/project-owners-168610916801", bucket, object, generation),
 				SelfLink:   fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s/acl/project-owners-168610916801", bucket, object),
 				Bucket:     bucket,
 				Object:     object,
-				Generation: 1570087904014021,
+				Generation: generation,
 				Entity:     "project-owners-168610916801",
 				Role:       "OWNER",
 				Etag:       "CMXdo57J/+QCEAE=",
@@ -259,8 +367,7 @@ func GenerateSimpleUpdateObjectAttrsOKResponse(bucket string, object string) (*h
 		Owner: &apigcs.ObjectOwner{
 			Entity: "user-faker@example.com",
 		},
-		Crc32c: "vOMu5Q==",
-		Etag:   "CMXdo57J/+QCEAE=",
+		Etag: "CMXdo57J/+QCEAE=",
 	}
 	body, err := json.Marshal(obj)
 	if err != nil {
@@ -280,10 +387,7 @@ func GenerateSimpleUpdateObjectAttrsOKResponse(bucket string, object string) (*h
 // AddUpdateObjectAttrsResponse is 指定したobjectのmetaのUpdateに対してのResponseを登録する
 // 同じ操作を複数回実行する時は複数回Addする
 func (faker *Faker) AddUpdateObjectAttrsResponse(bucket string, object string, response *http.Response) error {
-	if err := faker.AddResponse(fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=json&prettyPrint=false&projection=full", bucket, object), http.MethodPatch, response); err != nil {
-		return err
-	}
-	return nil
+	return faker.addKey(routeKey{operation: operationPatchObject, bucket: bucket, object: object}, response)
 }
 
 // AddUpdateObjectAttrsOKResponse is 指定したobjectのmetaのUpdateに対してのOKResponseを登録する
@@ -330,62 +434,87 @@ type Transport struct {
 	t             *testing.T
 	Transport     http.RoundTripper
 	fakeResponses *fakeResponses
+
+	// uploads is uploadType=resumable の Upload Session を保持する
+	uploads *resumableUploads
+
+	// server is stateful mode の時に登録された Response が無い Request を処理する
+	// stateful mode ではない時は nil
+	server *server
+
+	// recorder is 受け取った全ての Request と Upload を記録する
+	recorder *recorder
 }
 
 func (tran *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	fake, err := tran.fakeResponses.Get(req.URL.String(), req.Method)
+	ar := parseRequest(req)
+	recorded, err := tran.recorder.record(req, ar)
 	if err != nil {
-		if tran.t != nil {
-			tran.t.Fatal("unexpected: ", err)
-		} else {
-			return nil, fmt.Errorf("failed RoundTrip :%w", err)
+		return nil, err
+	}
+	req = withRecordedRequest(req, recorded)
+	if ar.operation == operationInsertObject && !ar.isResumableUpload() {
+		tran.recorder.recordSimpleUpload(req, ar, recorded)
+	}
+	fake, err := tran.fakeResponses.Get(req, ar)
+	if err == nil {
+		switch {
+		case ar.operation == operationDownloadObject:
+			fake, err := applyDownloadHash(fake)
+			if err != nil {
+				return nil, err
+			}
+			return applyRange(req, ar, fake)
+		case ar.operation == operationInsertObject && !ar.isResumableUpload():
+			attrs, content, err := readUpload(req, ar)
+			if err != nil {
+				return newErrorResponse(ar, err, nil), nil
+			}
+			h, err := hashReader(content)
+			if err != nil {
+				return newErrorResponse(ar, errInvalid(err.Error()), nil), nil
+			}
+			return cannedUploadResponse(ar, fake, attrs, h)
 		}
+		return fake, nil
 	}
-	return fake, nil
-}
-
-type fakeResponses struct {
-	// responseMap is RequestされたObjectのURLに対して返すResponseを保持する
-	// 同じObjectURLへのRequestの場合、順番に返していく
-	responseMap map[string]*http.Response
-
-	// requestCountMap is RequestされたObjectのURLをカウントする
-	requestCountMap map[string]int
-}
-
-func (f *fakeResponses) keyForResponseMap(url string, method string, count int) string {
-	return fmt.Sprintf("%s-%s-%d", url, strings.ToUpper(method), count)
-}
-
-func (f *fakeResponses) keyForRequestCountMap(url string, method string) string {
-	return fmt.Sprintf("%s-%s", url, strings.ToUpper(method))
-}
-
-func (f *fakeResponses) Add(url string, method string, response *http.Response) {
-	// countが空いてるところにAddする
-	for i := 0; i < math.MaxInt32; i++ {
-		key := f.keyForResponseMap(url, method, i)
-		_, ok := f.responseMap[key]
-		if ok {
-			continue
+	if ar.isResumableUpload() {
+		fake, err = tran.uploads.roundTrip(req, ar, tran.completeUpload)
+		if err == nil {
+			return fake, nil
 		}
-		f.responseMap[key] = response
-		break
+	} else if tran.server != nil {
+		return tran.server.roundTrip(req)
+	}
+	// RoundTrip は Client の goroutine から呼ばれるので、Fatal ではなく Errorf で報告して error を返す
+	unmatched := tran.fakeResponses.unmatched(req, ar)
+	if tran.t != nil {
+		tran.t.Errorf("unexpected: %s", unmatched.Report)
 	}
+	return nil, unmatched
 }
 
-func (f *fakeResponses) Get(url string, method string) (*http.Response, error) {
-	count, ok := f.requestCountMap[f.keyForRequestCountMap(url, method)]
-	if !ok {
-		count = 0
+// completeUpload is Resumable Upload の全ての chunk が揃った時の Response を返す
+// AddPostObjectOKResponse で登録された Response があればそれを返し、無ければ stateful mode の store に書き込む
+func (tran *Transport) completeUpload(req *http.Request, ar *apiRequest, attrs *apigcs.Object, blob *storedBlob, h *objectHash) (*http.Response, error) {
+	tran.recorder.recordBlobUpload(recordedRequestOf(req), ar, attrs, blob)
+	fake, err := tran.fakeResponses.GetKey(insertObjectKey(ar.bucket, attrs.Name), req)
+	if err == nil {
+		return cannedUploadResponse(ar, fake, attrs, h)
 	}
+	if tran.server != nil {
+		return tran.server.completeUpload(ar, attrs, blob, h)
+	}
+	return nil, err
+}
 
-	v, ok := f.responseMap[f.keyForResponseMap(url, method, count)]
-	if !ok {
-		return nil, fmt.Errorf("response is not registered. %s:%s RequestCount is %d", method, url, count+1)
+// cannedUploadResponse is 登録された Upload の Response を返す前に、Client が送ってきた MD5 と CRC32C を確認して、
+// Response の Object の md5Hash と crc32c を Upload された中身の h に合わせる
+func cannedUploadResponse(ar *apiRequest, res *http.Response, attrs *apigcs.Object, h *objectHash) (*http.Response, error) {
+	if err := h.verify(attrs); err != nil {
+		return newErrorResponse(ar, err, nil), nil
 	}
-	f.requestCountMap[f.keyForRequestCountMap(url, method)] = count + 1
-	return v, nil
+	return applyUploadHash(res, h)
 }
 
 func GetObjectOKResponseSample() *http.Response {
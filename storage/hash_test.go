@@ -0,0 +1,176 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func crc32cOf(body string) uint32 {
+	return crc32.Checksum([]byte(body), crc32.MakeTable(crc32.Castagnoli))
+}
+
+func xGoogHash(body string) []string {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32cOf(body))
+	sum := md5.Sum([]byte(body))
+	return []string{
+		"crc32c=" + base64.StdEncoding.EncodeToString(crc),
+		"md5=" + base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+func TestStatefulFaker_Hash(t *testing.T) {
+	ctx := context.Background()
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "hash.txt"
+	const body = "hello hash"
+	attrs := writeObject(t, stg, bucket, object, body)
+	sum := md5.Sum([]byte(body))
+	if e, g := sum[:], attrs.MD5; !cmp.Equal(e, g) {
+		t.Errorf("want md5 %x but got %x", e, g)
+	}
+	if e, g := crc32cOf(body), attrs.CRC32C; e != g {
+		t.Errorf("want crc32c %d but got %d", e, g)
+	}
+
+	res, err := faker.Client.Get(fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, object))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if e, g := xGoogHash(body), res.Header.Values("X-Goog-Hash"); !cmp.Equal(e, g) {
+		t.Errorf("unexpected X-Goog-Hash %s", cmp.Diff(e, g))
+	}
+
+	cases := []struct {
+		name     string
+		setHash  func(w *storage.Writer)
+		wantCode int
+	}{
+		{"crc32c", func(w *storage.Writer) { w.SendCRC32C = true; w.CRC32C = crc32cOf(body) }, http.StatusOK},
+		{"wrong crc32c", func(w *storage.Writer) { w.SendCRC32C = true; w.CRC32C = crc32cOf(body) + 1 }, http.StatusBadRequest},
+		{"md5", func(w *storage.Writer) { w.MD5 = sum[:] }, http.StatusOK},
+		{"wrong md5", func(w *storage.Writer) { s := md5.Sum([]byte("other")); w.MD5 = s[:] }, http.StatusBadRequest},
+	}
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			w := stg.Bucket(bucket).Object("verify.txt").NewWriter(ctx)
+			tt.setHash(w)
+			if _, err := w.Write([]byte(body)); err != nil {
+				t.Fatal(err)
+			}
+			err := w.Close()
+			if tt.wantCode == http.StatusOK {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var gerr *googleapi.Error
+			if !errors.As(err, &gerr) {
+				t.Fatalf("want googleapi.Error but got %v", err)
+			}
+			if e, g := tt.wantCode, gerr.Code; e != g {
+				t.Errorf("want status %d but got %d", e, g)
+			}
+		})
+	}
+}
+
+// TestFaker_HashWithRegisteredResponse is 登録した Response の Hash も中身に合わせて計算されることを確認する
+func TestFaker_HashWithRegisteredResponse(t *testing.T) {
+	ctx := context.Background()
+
+	faker := storagefaker.NewFaker(t)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "hash.txt"
+	const body = "registered body"
+
+	t.Run("download", func(t *testing.T) {
+		res := storagefaker.GetObjectOKResponseSample()
+		res.Body = io.NopCloser(strings.NewReader(body))
+		res.Header["Content-Length"] = []string{fmt.Sprint(len(body))}
+		res.Header.Del("X-Goog-Hash")
+		res.ContentLength = int64(len(body))
+		if err := faker.AddGetObjectResponse(bucket, object, res); err != nil {
+			t.Fatal(err)
+		}
+		r, err := stg.Bucket(bucket).Object(object).NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := body, string(got); e != g {
+			t.Errorf("want body %q but got %q", e, g)
+		}
+	})
+
+	t.Run("download with registered hash", func(t *testing.T) {
+		// 登録した X-Goog-Hash は body と合っていなくてもそのまま返す
+		res := storagefaker.GetObjectOKResponseSample()
+		res.Body = io.NopCloser(strings.NewReader(body))
+		res.Header["Content-Length"] = []string{fmt.Sprint(len(body))}
+		res.Header["X-Goog-Hash"] = xGoogHash("other body")
+		res.ContentLength = int64(len(body))
+		if err := faker.AddGetObjectResponse(bucket, object, res); err != nil {
+			t.Fatal(err)
+		}
+		r, err := stg.Bucket(bucket).Object(object).NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), "bad CRC") {
+			t.Errorf("want bad CRC error but got %v", err)
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		resp := storagefaker.GenerateSimplePostObjectOKResponse(bucket, object, "text/plain", uint64(len(body)))
+		if err := faker.AddPostObjectOKResponse(bucket, object, make(map[string][]string), resp); err != nil {
+			t.Fatal(err)
+		}
+		w := stg.Bucket(bucket).Object(object).NewWriter(ctx)
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		sum := md5.Sum([]byte(body))
+		if e, g := sum[:], w.Attrs().MD5; !cmp.Equal(e, g) {
+			t.Errorf("want md5 %x but got %x", e, g)
+		}
+		if e, g := crc32cOf(body), w.Attrs().CRC32C; e != g {
+			t.Errorf("want crc32c %d but got %d", e, g)
+		}
+	})
+}
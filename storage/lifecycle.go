@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// advanceTime is 仮想的な時刻を d だけ進めて、全ての Bucket の Lifecycle の rule を適用する
+func (s *store) advanceTime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clockOffset += d
+	now := s.now()
+	for _, b := range s.buckets {
+		b.applyLifecycle(now)
+	}
+}
+
+// currentTime is AdvanceTime で進めた仮想的な時刻を返す
+func (s *store) currentTime() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.now()
+}
+
+// applyLifecycle is Bucket の Lifecycle の rule に一致する Object に Action を実行する
+//
+// 全ての Object の rule の判定を先に行い、その後でまとめて Action を実行する
+// Delete は SetStorageClass よりも優先する
+// Versioning が有効な Bucket で live な Object を Delete した場合は noncurrent になる
+func (b *bucketEntry) applyLifecycle(now time.Time) {
+	if b.attrs.Lifecycle == nil || len(b.attrs.Lifecycle.Rule) == 0 {
+		return
+	}
+	type action struct {
+		object *objectEntry
+		rule   *apigcs.BucketLifecycleRule
+	}
+	var actions []*action
+	for _, generations := range b.generations() {
+		for i, o := range generations {
+			newer := int64(len(generations) - i - 1)
+			if rule := b.matchLifecycleRule(o, newer, now); rule != nil {
+				actions = append(actions, &action{object: o, rule: rule})
+			}
+		}
+	}
+	for _, a := range actions {
+		o := a.object
+		switch a.rule.Action.Type {
+		case "Delete":
+			// Hold や Retention Policy で保護されている Object は Lifecycle でも削除されない
+			if err := b.checkRetention(o, now); err != nil {
+				continue
+			}
+			if b.objects[o.attrs.Name] == o {
+				delete(b.objects, o.attrs.Name)
+				b.archive(o, now)
+				continue
+			}
+			b.removeNoncurrent(o)
+		case "SetStorageClass":
+			o.attrs.StorageClass = a.rule.Action.StorageClass
+			o.attrs.TimeStorageClassUpdated = now.UTC().Format(time.RFC3339Nano)
+		}
+	}
+}
+
+// generations is Object 名ごとに noncurrent と live の Object を Generation 順に並べて返す
+func (b *bucketEntry) generations() map[string][]*objectEntry {
+	m := make(map[string][]*objectEntry)
+	for name, l := range b.noncurrent {
+		m[name] = append(m[name], l...)
+	}
+	for name, o := range b.objects {
+		m[name] = append(m[name], o)
+	}
+	for _, l := range m {
+		sort.Slice(l, func(i, j int) bool {
+			return l[i].attrs.Generation < l[j].attrs.Generation
+		})
+	}
+	return m
+}
+
+// matchLifecycleRule is o に適用する rule を返す
+// newer は o よりも新しい Generation の数
+// Delete の rule に一致する場合はそれを、それ以外は最後に一致した SetStorageClass の rule を返す
+func (b *bucketEntry) matchLifecycleRule(o *objectEntry, newer int64, now time.Time) *apigcs.BucketLifecycleRule {
+	live := b.objects[o.attrs.Name] == o
+
+	var matched *apigcs.BucketLifecycleRule
+	for _, rule := range b.attrs.Lifecycle.Rule {
+		if rule.Action == nil || rule.Condition == nil || !matchLifecycleCondition(rule.Condition, o.attrs, live, newer, now) {
+			continue
+		}
+		if rule.Action.Type == "Delete" {
+			return rule
+		}
+		matched = rule
+	}
+	return matched
+}
+
+// matchLifecycleCondition is Object が Condition の全ての項目を満たしているかを返す
+func matchLifecycleCondition(c *apigcs.BucketLifecycleRuleCondition, attrs *apigcs.Object, live bool, newer int64, now time.Time) bool {
+	created, _ := time.Parse(time.RFC3339Nano, attrs.TimeCreated)
+	if c.Age != nil && daysSince(created, now) < *c.Age {
+		return false
+	}
+	if c.CreatedBefore != "" && !beforeDate(created, c.CreatedBefore) {
+		return false
+	}
+	if c.IsLive != nil && *c.IsLive != live {
+		return false
+	}
+	if c.NumNewerVersions > 0 && newer < c.NumNewerVersions {
+		return false
+	}
+	if len(c.MatchesPrefix) > 0 && !matchesAny(attrs.Name, c.MatchesPrefix, strings.HasPrefix) {
+		return false
+	}
+	if len(c.MatchesSuffix) > 0 && !matchesAny(attrs.Name, c.MatchesSuffix, strings.HasSuffix) {
+		return false
+	}
+	if len(c.MatchesStorageClass) > 0 && !matchesAny(attrs.StorageClass, c.MatchesStorageClass, func(a, b string) bool { return a == b }) {
+		return false
+	}
+	if c.DaysSinceNoncurrentTime > 0 || c.NoncurrentTimeBefore != "" {
+		deleted, err := time.Parse(time.RFC3339Nano, attrs.TimeDeleted)
+		if live || err != nil {
+			return false
+		}
+		if c.DaysSinceNoncurrentTime > 0 && daysSince(deleted, now) < c.DaysSinceNoncurrentTime {
+			return false
+		}
+		if c.NoncurrentTimeBefore != "" && !beforeDate(deleted, c.NoncurrentTimeBefore) {
+			return false
+		}
+	}
+	if c.DaysSinceCustomTime > 0 || c.CustomTimeBefore != "" {
+		custom, err := time.Parse(time.RFC3339Nano, attrs.CustomTime)
+		if err != nil {
+			return false
+		}
+		if c.DaysSinceCustomTime > 0 && daysSince(custom, now) < c.DaysSinceCustomTime {
+			return false
+		}
+		if c.CustomTimeBefore != "" && !beforeDate(custom, c.CustomTimeBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// daysSince is t から now までに経過した日数を返す
+func daysSince(t time.Time, now time.Time) int64 {
+	return int64(now.Sub(t) / (24 * time.Hour))
+}
+
+// beforeDate is t が "2006-01-02" 形式の date の 0 時 (UTC) よりも前かどうかを返す
+func beforeDate(t time.Time, date string) bool {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return false
+	}
+	return t.Before(d)
+}
+
+func matchesAny(v string, patterns []string, match func(string, string) bool) bool {
+	for _, p := range patterns {
+		if match(v, p) {
+			return true
+		}
+	}
+	return false
+}
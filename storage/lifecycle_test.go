@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/iterator"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func TestStatefulFaker_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake-lifecycle"
+	err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", &storage.BucketAttrs{
+		Lifecycle: storage.Lifecycle{
+			Rules: []storage.LifecycleRule{
+				{
+					Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+					Condition: storage.LifecycleCondition{AgeInDays: 30, MatchesPrefix: []string{"logs/"}},
+				},
+				{
+					Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "COLDLINE"},
+					Condition: storage.LifecycleCondition{AgeInDays: 10, MatchesSuffix: []string{".bak"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"logs/a.txt", "data/b.bak", "data/c.txt"} {
+		writeObject(t, stg, bucket, name, name)
+	}
+	bkt := stg.Bucket(bucket)
+
+	if err := faker.AdvanceTime(11 * 24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := bkt.Object("data/b.bak").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "COLDLINE", attrs.StorageClass; e != g {
+		t.Errorf("want storageClass %s but got %s", e, g)
+	}
+	if _, err := bkt.Object("logs/a.txt").Attrs(ctx); err != nil {
+		t.Errorf("logs/a.txt should not be deleted yet. %v", err)
+	}
+
+	if err := faker.AdvanceTime(20 * 24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bkt.Object("logs/a.txt").Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("want ErrObjectNotExist but got %v", err)
+	}
+	attrs, err = bkt.Object("data/c.txt").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "STANDARD", attrs.StorageClass; e != g {
+		t.Errorf("want storageClass %s but got %s", e, g)
+	}
+}
+
+func TestStatefulFaker_LifecycleNumNewerVersions(t *testing.T) {
+	ctx := context.Background()
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake-lifecycle"
+	const object = "versioned.txt"
+	err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", &storage.BucketAttrs{
+		VersioningEnabled: true,
+		Lifecycle: storage.Lifecycle{
+			Rules: []storage.LifecycleRule{
+				{
+					Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+					Condition: storage.LifecycleCondition{Liveness: storage.Archived, NumNewerVersions: 2},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generations []int64
+	for i := 0; i < 4; i++ {
+		attrs := writeObject(t, stg, bucket, object, "body")
+		generations = append(generations, attrs.Generation)
+	}
+
+	if err := faker.AdvanceTime(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	it := stg.Bucket(bucket).Objects(ctx, &storage.Query{Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, attrs.Generation)
+	}
+	if e := generations[2:]; !cmp.Equal(e, got) {
+		t.Errorf("unexpected generations %s", cmp.Diff(e, got))
+	}
+}
+
+func TestFaker_AdvanceTimeWithoutStatefulMode(t *testing.T) {
+	faker := storagefaker.NewFaker(t)
+	if err := faker.AdvanceTime(time.Hour); err == nil {
+		t.Error("want error but got nil")
+	}
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// defaultMaxResults is maxResults が指定されていない時に1回の objects.list で返す件数
+// GCS と同じく 1000 件で、これより大きな値を指定されても 1000 件までしか返さない
+const defaultMaxResults = 1000
+
+// listQuery is objects.list の Query Parameter
+type listQuery struct {
+	prefix                   string
+	delimiter                string
+	startOffset              string
+	endOffset                string
+	matchGlob                string
+	versions                 bool
+	includeTrailingDelimiter bool
+	projection               string
+	pageToken                string
+	maxResults               int
+}
+
+// listResult is objects.list の結果の1 page
+type listResult struct {
+	items         []*apigcs.Object
+	prefixes      []string
+	nextPageToken string
+}
+
+// listEntry is items と prefixes を名前順に並べて page に分けるための要素
+type listEntry struct {
+	// key is Object 名か prefix
+	key string
+
+	// object is Object の場合に値が入る
+	// prefix の場合は nil
+	object *apigcs.Object
+}
+
+// listPageToken is nextPageToken の中身
+// 前の page の最後の要素を保持していて、次の page はその次の要素から始める
+type listPageToken struct {
+	Key        string `json:"k"`
+	IsObject   bool   `json:"o"`
+	Generation int64  `json:"g"`
+}
+
+func parseListQuery(q url.Values) (*listQuery, error) {
+	lq := &listQuery{
+		prefix:      q.Get("prefix"),
+		delimiter:   q.Get("delimiter"),
+		startOffset: q.Get("startOffset"),
+		endOffset:   q.Get("endOffset"),
+		matchGlob:   q.Get("matchGlob"),
+		projection:  q.Get("projection"),
+		pageToken:   q.Get("pageToken"),
+		maxResults:  defaultMaxResults,
+	}
+	var err error
+	if v := q.Get("versions"); v != "" {
+		if lq.versions, err = strconv.ParseBool(v); err != nil {
+			return nil, errInvalid(fmt.Sprintf("Invalid value for versions: %s", v))
+		}
+	}
+	if v := q.Get("includeTrailingDelimiter"); v != "" {
+		if lq.includeTrailingDelimiter, err = strconv.ParseBool(v); err != nil {
+			return nil, errInvalid(fmt.Sprintf("Invalid value for includeTrailingDelimiter: %s", v))
+		}
+	}
+	if v := q.Get("maxResults"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errInvalid(fmt.Sprintf("Invalid value for maxResults: %s", v))
+		}
+		if n > 0 && n < defaultMaxResults {
+			lq.maxResults = n
+		}
+	}
+	return lq, nil
+}
+
+// listObjects is 名前順 (同じ名前の場合は Generation 順) に並んだ Object から Query に一致するものを1 page 分返す
+//
+// delimiter を指定した場合、prefix の後ろに delimiter を含む Object はまとめて prefixes として返す
+// maxResults は items と prefixes を合わせた件数に対して適用する
+func listObjects(objects []*apigcs.Object, q *listQuery) (*listResult, error) {
+	var token *listPageToken
+	if q.pageToken != "" {
+		b, err := base64.RawURLEncoding.DecodeString(q.pageToken)
+		if err != nil {
+			return nil, errInvalid(fmt.Sprintf("Invalid page token: %s", q.pageToken))
+		}
+		token = &listPageToken{}
+		if err := json.Unmarshal(b, token); err != nil {
+			return nil, errInvalid(fmt.Sprintf("Invalid page token: %s", q.pageToken))
+		}
+	}
+	var glob *regexp.Regexp
+	if q.matchGlob != "" {
+		var err error
+		glob, err = globToRegexp(q.matchGlob)
+		if err != nil {
+			return nil, errInvalid(fmt.Sprintf("Invalid matchGlob %q : %s", q.matchGlob, err))
+		}
+	}
+
+	var entries []*listEntry
+	seenPrefixes := make(map[string]bool)
+	for _, o := range objects {
+		if !strings.HasPrefix(o.Name, q.prefix) {
+			continue
+		}
+		if q.startOffset != "" && o.Name < q.startOffset {
+			continue
+		}
+		if q.endOffset != "" && o.Name >= q.endOffset {
+			continue
+		}
+		if glob != nil && !glob.MatchString(o.Name) {
+			continue
+		}
+		if q.delimiter != "" {
+			rest := o.Name[len(q.prefix):]
+			if i := strings.Index(rest, q.delimiter); i >= 0 {
+				p := q.prefix + rest[:i+len(q.delimiter)]
+				if !seenPrefixes[p] {
+					seenPrefixes[p] = true
+					entries = append(entries, &listEntry{key: p})
+				}
+				// includeTrailingDelimiter の時は delimiter で終わる Object は prefix と一緒に items にも含める
+				if !(q.includeTrailingDelimiter && p == o.Name) {
+					continue
+				}
+			}
+		}
+		entries = append(entries, &listEntry{key: o.Name, object: o})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].less(entries[j])
+	})
+
+	res := &listResult{}
+	var count int
+	for i, e := range entries {
+		if token != nil && !token.before(e) {
+			continue
+		}
+		if count == q.maxResults {
+			last := entries[i-1]
+			b, err := json.Marshal(last.pageToken())
+			if err != nil {
+				return nil, err
+			}
+			res.nextPageToken = base64.RawURLEncoding.EncodeToString(b)
+			break
+		}
+		count++
+		if e.object == nil {
+			res.prefixes = append(res.prefixes, e.key)
+			continue
+		}
+		res.items = append(res.items, applyProjection(e.object, q.projection))
+	}
+	return res, nil
+}
+
+// less is 名前順、同じ名前の場合は prefix、Object の Generation 順に並べる
+func (e *listEntry) less(o *listEntry) bool {
+	if e.key != o.key {
+		return e.key < o.key
+	}
+	if (e.object == nil) != (o.object == nil) {
+		return e.object == nil
+	}
+	if e.object == nil {
+		return false
+	}
+	return e.object.Generation < o.object.Generation
+}
+
+func (e *listEntry) pageToken() *listPageToken {
+	t := &listPageToken{Key: e.key}
+	if e.object != nil {
+		t.IsObject = true
+		t.Generation = e.object.Generation
+	}
+	return t
+}
+
+// before is page token が表す要素が e よりも前にある場合 true を返す
+func (t *listPageToken) before(e *listEntry) bool {
+	te := &listEntry{key: t.Key}
+	if t.IsObject {
+		te.object = &apigcs.Object{Generation: t.Generation}
+	}
+	return te.less(e)
+}
+
+// applyProjection is projection=noAcl の時に acl と owner を取り除いた Object を返す
+// projection が指定されていない時は GCS と同じく noAcl として扱う
+func applyProjection(obj *apigcs.Object, projection string) *apigcs.Object {
+	if projection == "full" {
+		return obj
+	}
+	v := *obj
+	v.Acl = nil
+	v.Owner = nil
+	return &v
+}
+
+// globToRegexp is matchGlob の glob を正規表現に変換する
+//
+// * は / 以外の0文字以上、** は / を含む0文字以上、? は / 以外の1文字にそれぞれ一致する
+// [abc], [a-z], [!abc] の文字クラスと {a,b} の選択も使える
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	inBrace := false
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// **/ は0個以上の directory に一致する
+					i++
+					sb.WriteString("(?:.*/)?")
+					continue
+				}
+				sb.WriteString(".*")
+				continue
+			}
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(glob[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := glob[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += j
+		case '{':
+			if inBrace {
+				return nil, fmt.Errorf("nested braces are not supported")
+			}
+			inBrace = true
+			sb.WriteString("(?:")
+		case '}':
+			if !inBrace {
+				sb.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			inBrace = false
+			sb.WriteString(")")
+		case ',':
+			if inBrace {
+				sb.WriteString("|")
+				continue
+			}
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+				continue
+			}
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if inBrace {
+		return nil, fmt.Errorf("unterminated brace")
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
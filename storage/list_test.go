@@ -0,0 +1,158 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/iterator"
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+func listObjectNames(t *testing.T, stg *storage.Client, bucket string, q *storage.Query) []string {
+	t.Helper()
+
+	var got []string
+	it := stg.Bucket(bucket).Objects(context.Background(), q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Prefix != "" {
+			got = append(got, "prefix:"+attrs.Prefix)
+			continue
+		}
+		got = append(got, attrs.Name)
+	}
+	return got
+}
+
+func TestStatefulFaker_ListObjectsQuery(t *testing.T) {
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	for _, name := range []string{"a.txt", "dir/", "dir/1.txt", "dir/2.csv", "dir/sub/3.txt", "e.txt", "z/4.txt"} {
+		writeObject(t, stg, bucket, name, name)
+	}
+
+	cases := []struct {
+		name  string
+		query *storage.Query
+		want  []string
+	}{
+		{"all", nil, []string{"a.txt", "dir/", "dir/1.txt", "dir/2.csv", "dir/sub/3.txt", "e.txt", "z/4.txt"}},
+		{"delimiter", &storage.Query{Delimiter: "/"}, []string{"a.txt", "e.txt", "prefix:dir/", "prefix:z/"}},
+		{"prefix and delimiter", &storage.Query{Prefix: "dir/", Delimiter: "/"}, []string{"dir/", "dir/1.txt", "dir/2.csv", "prefix:dir/sub/"}},
+		{"include trailing delimiter", &storage.Query{Delimiter: "/", IncludeTrailingDelimiter: true}, []string{"a.txt", "dir/", "e.txt", "prefix:dir/", "prefix:z/"}},
+		{"offset", &storage.Query{StartOffset: "dir/1.txt", EndOffset: "e.txt"}, []string{"dir/1.txt", "dir/2.csv", "dir/sub/3.txt"}},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got := listObjectNames(t, stg, bucket, tt.query)
+			if !cmp.Equal(tt.want, got) {
+				t.Errorf("unexpected list %s", cmp.Diff(tt.want, got))
+			}
+		})
+	}
+}
+
+func TestStatefulFaker_ListObjectsPagination(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("dir%d/%d.txt", i, i)
+		writeObject(t, stg, bucket, name, name)
+	}
+	writeObject(t, stg, bucket, "file.txt", "file")
+	// prefix と item はそれぞれの page の中で item, prefix の順に並ぶ
+	wantPages := [][]string{
+		{"prefix:dir0/", "prefix:dir1/"},
+		{"prefix:dir2/", "prefix:dir3/"},
+		{"file.txt", "prefix:dir4/"},
+	}
+
+	it := stg.Bucket(bucket).Objects(ctx, &storage.Query{Delimiter: "/"})
+	pager := iterator.NewPager(it, 2, "")
+	var gotPages [][]string
+	for {
+		var page []*storage.ObjectAttrs
+		token, err := pager.NextPage(&page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, attrs := range page {
+			if attrs.Prefix != "" {
+				names = append(names, "prefix:"+attrs.Prefix)
+				continue
+			}
+			names = append(names, attrs.Name)
+		}
+		gotPages = append(gotPages, names)
+		if token == "" {
+			break
+		}
+	}
+	if !cmp.Equal(wantPages, gotPages) {
+		t.Errorf("unexpected pages %s", cmp.Diff(wantPages, gotPages))
+	}
+}
+
+func TestStatefulFaker_ListObjectsMatchGlob(t *testing.T) {
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	for _, name := range []string{"a.txt", "a.csv", "dir/b.txt", "dir/sub/c.txt", "dir/sub/d.json"} {
+		writeObject(t, stg, bucket, name, name)
+	}
+
+	cases := []struct {
+		glob string
+		want []string
+	}{
+		{"*.txt", []string{"a.txt"}},
+		{"**.txt", []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"}},
+		{"dir/**/*.txt", []string{"dir/b.txt", "dir/sub/c.txt"}},
+		{"a.{txt,csv}", []string{"a.csv", "a.txt"}},
+		{"dir/sub/[cd].*", []string{"dir/sub/c.txt", "dir/sub/d.json"}},
+		{"?.txt", []string{"a.txt"}},
+	}
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.glob, func(t *testing.T) {
+			u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o?matchGlob=%s", bucket, url.QueryEscape(tt.glob))
+			res, err := faker.Client.Get(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if e, g := http.StatusOK, res.StatusCode; e != g {
+				t.Fatalf("want status %d but got %d", e, g)
+			}
+			var objects apigcs.Objects
+			if err := json.NewDecoder(res.Body).Decode(&objects); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, item := range objects.Items {
+				got = append(got, item.Name)
+			}
+			if !cmp.Equal(tt.want, got) {
+				t.Errorf("unexpected list %s", cmp.Diff(tt.want, got))
+			}
+		})
+	}
+}
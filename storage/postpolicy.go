@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postPolicyForm is POST Policy の multipart/form-data の Upload
+type postPolicyForm struct {
+	bucket string
+
+	// fields is file 以外の form の field で、名前は小文字にしている
+	fields map[string]string
+
+	filename string
+	content  []byte
+}
+
+// postPolicyDocument is base64 encode された policy field の中身
+type postPolicyDocument struct {
+	Expiration string            `json:"expiration"`
+	Conditions []json.RawMessage `json:"conditions"`
+}
+
+func errInvalidPolicyDocument(message string) error {
+	return &storeError{
+		code:    http.StatusBadRequest,
+		reason:  "invalid",
+		message: message,
+		xmlCode: "InvalidPolicyDocument",
+	}
+}
+
+func errPolicyConditionNotMet(message string) error {
+	return &storeError{
+		code:    http.StatusForbidden,
+		reason:  "forbidden",
+		message: fmt.Sprintf("Invalid according to Policy: %s", message),
+		xmlCode: "AccessDenied",
+	}
+}
+
+func errEntitySize(tooLarge bool, size int, min int64, max int64) error {
+	code := "EntityTooSmall"
+	if tooLarge {
+		code = "EntityTooLarge"
+	}
+	return &storeError{
+		code:    http.StatusBadRequest,
+		reason:  "invalid",
+		message: fmt.Sprintf("Your proposed upload is not within the content-length-range %d to %d. Size is %d.", min, max, size),
+		xmlCode: code,
+	}
+}
+
+// isPostPolicyRequest is Request が POST Policy の form での Upload かどうかを返す
+func isPostPolicyRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// servePostPolicy is POST Policy の form の署名と条件を確認して、Object を Upload する
+// Upload は XML API の PUT Object として Faker の Transport で処理する
+func (s *SignedURLServer) servePostPolicy(w http.ResponseWriter, r *http.Request, ar *apiRequest) {
+	form, err := readPostPolicyForm(r, ar.bucket)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	if err := s.verifyPostPolicy(form); err != nil {
+		writeError(w, ar, err)
+		return
+	}
+
+	key := strings.Replace(form.fields["key"], "${filename}", form.filename, -1)
+	u := &url.URL{Path: fmt.Sprintf("/%s/%s", form.bucket, key)}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, gcsBaseURL+u.EscapedPath(), bytes.NewReader(form.content))
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	for name, header := range map[string]string{
+		"content-type":        "Content-Type",
+		"cache-control":       "Cache-Control",
+		"content-disposition": "Content-Disposition",
+		"content-encoding":    "Content-Encoding",
+		"content-language":    "Content-Language",
+	} {
+		if v, ok := form.fields[name]; ok {
+			req.Header.Set(header, v)
+		}
+	}
+	for k, v := range form.fields {
+		if strings.HasPrefix(k, "x-goog-meta-") {
+			req.Header.Set(k, v)
+		}
+	}
+	res, err := s.faker.transport.RoundTrip(req)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		_, _ = io.Copy(w, res.Body)
+		return
+	}
+	writePostPolicyResponse(w, form, key, res.Header.Get("ETag"))
+}
+
+// readPostPolicyForm is multipart/form-data の field と file を読み込む
+// file より後ろの field は GCS と同じように無視する
+func readPostPolicyForm(r *http.Request, bucket string) (*postPolicyForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, errInvalid(err.Error())
+	}
+	form := &postPolicyForm{
+		bucket: bucket,
+		fields: make(map[string]string),
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errInvalid("file field is missing.")
+		}
+		if err != nil {
+			return nil, errInvalid(err.Error())
+		}
+		b, err := io.ReadAll(part)
+		if err != nil {
+			return nil, errInvalid(err.Error())
+		}
+		name := strings.ToLower(part.FormName())
+		if name == "file" {
+			form.filename = part.FileName()
+			form.content = b
+			return form, nil
+		}
+		form.fields[name] = string(b)
+	}
+}
+
+// verifyPostPolicy is policy の署名と有効期限を確認し、form が policy の条件を全て満たしているかを確認する
+// 有効期限は Faker の仮想的な時刻で判定する
+func (s *SignedURLServer) verifyPostPolicy(form *postPolicyForm) error {
+	policy := form.fields["policy"]
+	signature := form.fields["x-goog-signature"]
+	if policy == "" || signature == "" {
+		return errAuthenticationRequired()
+	}
+	if v := form.fields["x-goog-algorithm"]; v != signedURLAlgorithm {
+		return errInvalid(fmt.Sprintf("Unsupported x-goog-algorithm %q", v))
+	}
+	credential := strings.SplitN(form.fields["x-goog-credential"], "/", 2)
+	s.mu.RLock()
+	key, ok := s.keys[credential[0]]
+	s.mu.RUnlock()
+	if !ok {
+		return errSignatureDoesNotMatch(fmt.Sprintf("Service account %s is not registered.", credential[0]))
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return errSignatureDoesNotMatch("x-goog-signature is not hex encoded.")
+	}
+	digest := sha256.Sum256([]byte(policy))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return errSignatureDoesNotMatch("The request signature we calculated does not match the signature you provided. Check your Google secret key and signing method.")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(policy)
+	if err != nil {
+		return errInvalidPolicyDocument(fmt.Sprintf("Invalid policy document: %v", err))
+	}
+	var doc postPolicyDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return errInvalidPolicyDocument(fmt.Sprintf("Invalid policy document: %v", err))
+	}
+	expiration, err := time.Parse(time.RFC3339, doc.Expiration)
+	if err != nil {
+		return errInvalidPolicyDocument(fmt.Sprintf("Invalid expiration %q", doc.Expiration))
+	}
+	if !s.faker.now().Before(expiration) {
+		return errPolicyConditionNotMet("Policy expired.")
+	}
+	return form.checkConditions(doc.Conditions)
+}
+
+// checkConditions is form が policy の全ての条件を満たしていて、
+// policy, x-goog-signature, x-ignore- で始まる field 以外の全ての field が条件に含まれているかを確認する
+func (form *postPolicyForm) checkConditions(conditions []json.RawMessage) error {
+	covered := map[string]bool{"bucket": true}
+	for _, raw := range conditions {
+		var exact map[string]string
+		if err := json.Unmarshal(raw, &exact); err == nil {
+			for k, v := range exact {
+				name := strings.ToLower(k)
+				covered[name] = true
+				if form.value(name) != v {
+					return errPolicyConditionNotMet(fmt.Sprintf("Policy Condition failed: [\"eq\", \"$%s\", %q]", name, v))
+				}
+			}
+			continue
+		}
+		var cond []interface{}
+		if err := json.Unmarshal(raw, &cond); err != nil || len(cond) != 3 {
+			return errInvalidPolicyDocument(fmt.Sprintf("Invalid policy condition %s", raw))
+		}
+		op, _ := cond[0].(string)
+		op = strings.ToLower(op)
+		switch op {
+		case "eq", "starts-with":
+			field, _ := cond[1].(string)
+			v, _ := cond[2].(string)
+			name := strings.ToLower(strings.TrimPrefix(field, "$"))
+			covered[name] = true
+			got := form.value(name)
+			if (op == "eq" && got != v) || (op != "eq" && !strings.HasPrefix(got, v)) {
+				return errPolicyConditionNotMet(fmt.Sprintf("Policy Condition failed: [%q, %q, %q]", op, field, v))
+			}
+		case "content-length-range":
+			min, minErr := policyNumber(cond[1])
+			max, maxErr := policyNumber(cond[2])
+			if minErr != nil || maxErr != nil {
+				return errInvalidPolicyDocument(fmt.Sprintf("Invalid policy condition %s", raw))
+			}
+			if size := len(form.content); int64(size) < min || int64(size) > max {
+				return errEntitySize(int64(size) > max, size, min, max)
+			}
+		default:
+			return errInvalidPolicyDocument(fmt.Sprintf("Invalid policy condition %s", raw))
+		}
+	}
+	for name := range form.fields {
+		if name == "policy" || name == "x-goog-signature" || strings.HasPrefix(name, "x-ignore-") || covered[name] {
+			continue
+		}
+		return errPolicyConditionNotMet(fmt.Sprintf("Extra input fields: %s", name))
+	}
+	return nil
+}
+
+// value is 条件で確認する field の値を返す
+// bucket は form の field ではなく、URL の Bucket になる
+func (form *postPolicyForm) value(name string) string {
+	if name == "bucket" {
+		return form.bucket
+	}
+	return form.fields[name]
+}
+
+// policyNumber is content-length-range の値を返す
+// 数値と文字列のどちらでも指定できる
+func policyNumber(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case float64:
+		return int64(n), nil
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	}
+	return 0, fmt.Errorf("invalid number %v", v)
+}
+
+// postResponse is success_action_status=201 の時に返す XML
+type postResponse struct {
+	XMLName  xml.Name `xml:"PostResponse"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// writePostPolicyResponse is Upload に成功した時の Response を返す
+// success_action_redirect がある場合は 303 で Redirect し、
+// それ以外は success_action_status に合わせて 200, 201, 204 のどれかを返す
+func writePostPolicyResponse(w http.ResponseWriter, form *postPolicyForm, key string, etag string) {
+	if v := form.fields["success_action_redirect"]; v != "" {
+		if u, err := url.Parse(v); err == nil {
+			q := u.Query()
+			q.Set("bucket", form.bucket)
+			q.Set("key", key)
+			q.Set("etag", etag)
+			u.RawQuery = q.Encode()
+			w.Header().Set("Location", u.String())
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+	}
+	w.Header().Set("ETag", etag)
+	switch form.fields["success_action_status"] {
+	case "200":
+		w.WriteHeader(http.StatusOK)
+	case "201":
+		b, _ := xml.Marshal(&postResponse{
+			Location: fmt.Sprintf("%s/%s/%s", gcsBaseURL, form.bucket, url.PathEscape(key)),
+			Bucket:   form.bucket,
+			Key:      key,
+			ETag:     etag,
+		})
+		w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, xml.Header)
+		_, _ = w.Write(b)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,173 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func postPolicyForm(t *testing.T, pp *storage.PostPolicyV4, extra map[string]string, filename string, content string) (*http.Response, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range pp.Fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, v := range extra {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(fw, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Post(pp.URL, mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+func generatePostPolicy(t *testing.T, pemKey []byte, object string, fields *storage.PolicyV4Fields, conditions ...storage.PostPolicyV4Condition) *storage.PostPolicyV4 {
+	t.Helper()
+
+	pp, err := storage.GenerateSignedPostPolicyV4("sinmetal-ci-fake", object, &storage.PostPolicyV4Options{
+		GoogleAccessID: signedURLAccessID,
+		PrivateKey:     pemKey,
+		Expires:        time.Now().Add(time.Hour),
+		Insecure:       true,
+		Fields:         fields,
+		Conditions:     conditions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pp
+}
+
+func TestSignedURLServer_PostPolicy(t *testing.T) {
+	faker, stg := newStatefulClient(t)
+	_, pemKey := newSignedURLServer(t, faker)
+
+	pp := generatePostPolicy(t, pemKey, "uploads/${filename}",
+		&storage.PolicyV4Fields{ContentType: "text/plain", Metadata: map[string]string{"x-goog-meta-owner": "sinmetal"}},
+		storage.ConditionContentLengthRange(1, 16),
+		storage.ConditionStartsWith("$x-ignore-note", ""),
+	)
+	res, body := postPolicyForm(t, pp, nil, "hello.txt", "Hello POST")
+	if e, g := http.StatusNoContent, res.StatusCode; e != g {
+		t.Fatalf("want status %d but got %d. %s", e, g, body)
+	}
+	if e, g := "Hello POST", readObject(t, stg, "sinmetal-ci-fake", "uploads/hello.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	attrs, err := stg.Bucket("sinmetal-ci-fake").Object("uploads/hello.txt").Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "text/plain", attrs.ContentType; e != g {
+		t.Errorf("want ContentType %s but got %s", e, g)
+	}
+	if e, g := "sinmetal", attrs.Metadata["owner"]; e != g {
+		t.Errorf("want metadata owner %s but got %s", e, g)
+	}
+}
+
+func TestSignedURLServer_PostPolicySuccessAction(t *testing.T) {
+	faker, _ := newStatefulClient(t)
+	_, pemKey := newSignedURLServer(t, faker)
+
+	pp := generatePostPolicy(t, pemKey, "status.txt", &storage.PolicyV4Fields{StatusCodeOnSuccess: 201})
+	res, body := postPolicyForm(t, pp, nil, "status.txt", "status")
+	if e, g := http.StatusCreated, res.StatusCode; e != g {
+		t.Fatalf("want status %d but got %d. %s", e, g, body)
+	}
+	if !bytes.Contains([]byte(body), []byte("<Key>status.txt</Key>")) {
+		t.Errorf("unexpected PostResponse %s", body)
+	}
+
+	pp = generatePostPolicy(t, pemKey, "redirect.txt", &storage.PolicyV4Fields{RedirectToURLOnSuccess: "https://example.com/done"})
+	res, body = postPolicyForm(t, pp, nil, "redirect.txt", "redirect")
+	if e, g := http.StatusSeeOther, res.StatusCode; e != g {
+		t.Fatalf("want status %d but got %d. %s", e, g, body)
+	}
+	u, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "redirect.txt", u.Query().Get("key"); e != g {
+		t.Errorf("want key %s but got %s", e, g)
+	}
+	if e, g := "sinmetal-ci-fake", u.Query().Get("bucket"); e != g {
+		t.Errorf("want bucket %s but got %s", e, g)
+	}
+}
+
+func TestSignedURLServer_PostPolicyRejected(t *testing.T) {
+	faker, _ := newStatefulClient(t)
+	_, pemKey := newSignedURLServer(t, faker)
+
+	t.Run("content-length-range", func(t *testing.T) {
+		pp := generatePostPolicy(t, pemKey, "large.txt", nil, storage.ConditionContentLengthRange(1, 4))
+		res, body := postPolicyForm(t, pp, nil, "large.txt", "too large")
+		assertXMLErrorCode(t, res, body, http.StatusBadRequest, "EntityTooLarge")
+	})
+	t.Run("starts-with", func(t *testing.T) {
+		pp := generatePostPolicy(t, pemKey, "${filename}", nil, storage.ConditionStartsWith("$key", "uploads/"))
+		res, body := postPolicyForm(t, pp, nil, "other.txt", "other")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "AccessDenied")
+	})
+	t.Run("tampered field", func(t *testing.T) {
+		pp := generatePostPolicy(t, pemKey, "fixed.txt", nil)
+		pp.Fields["key"] = "other.txt"
+		res, body := postPolicyForm(t, pp, nil, "fixed.txt", "tampered")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "AccessDenied")
+	})
+	t.Run("extra field", func(t *testing.T) {
+		pp := generatePostPolicy(t, pemKey, "extra.txt", nil)
+		res, body := postPolicyForm(t, pp, map[string]string{"content-type": "text/html"}, "extra.txt", "extra")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "AccessDenied")
+	})
+	t.Run("signature", func(t *testing.T) {
+		pp := generatePostPolicy(t, pemKey, "signature.txt", nil)
+		pp.Fields["x-goog-signature"] = pp.Fields["x-goog-signature"][2:] + "00"
+		res, body := postPolicyForm(t, pp, nil, "signature.txt", "signature")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "SignatureDoesNotMatch")
+	})
+	t.Run("expired", func(t *testing.T) {
+		pp := generatePostPolicy(t, pemKey, "expired.txt", nil)
+		if err := faker.AdvanceTime(2 * time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		res, body := postPolicyForm(t, pp, nil, "expired.txt", "expired")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "AccessDenied")
+	})
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// conditions is Request で指定された Generation と Precondition
+//
+// JSON API は Query Parameter で、XML API は x-goog-if-* Header で指定される
+// 指定されていない項目は nil
+type conditions struct {
+	// generation is 操作対象の Object の Generation
+	generation *int64
+
+	ifGenerationMatch        *int64
+	ifGenerationNotMatch     *int64
+	ifMetagenerationMatch    *int64
+	ifMetagenerationNotMatch *int64
+}
+
+func errPreconditionFailed() error {
+	return &storeError{
+		code:    http.StatusPreconditionFailed,
+		reason:  "conditionNotMet",
+		message: "At least one of the pre-conditions you specified did not hold.",
+	}
+}
+
+// conditionParam is conditions の1項目を指定する Query Parameter と Header の名前
+type conditionParam struct {
+	name   string
+	header string
+}
+
+var (
+	// destinationConditionParams is 操作対象の Object に対する Generation と Precondition
+	destinationConditionParams = [...]conditionParam{
+		{"generation", ""},
+		{"ifGenerationMatch", "X-Goog-If-Generation-Match"},
+		{"ifGenerationNotMatch", ""},
+		{"ifMetagenerationMatch", "X-Goog-If-Metageneration-Match"},
+		{"ifMetagenerationNotMatch", ""},
+	}
+
+	// sourceConditionParams is objects.rewrite の コピー元の Object に対する Generation と Precondition
+	sourceConditionParams = [...]conditionParam{
+		{"sourceGeneration", ""},
+		{"ifSourceGenerationMatch", ""},
+		{"ifSourceGenerationNotMatch", ""},
+		{"ifSourceMetagenerationMatch", ""},
+		{"ifSourceMetagenerationNotMatch", ""},
+	}
+)
+
+// parseConditions is Request から Generation と Precondition を読み取る
+func parseConditions(ar *apiRequest) (*conditions, error) {
+	return parseConditionParams(ar, destinationConditionParams)
+}
+
+// parseSourceConditions is objects.rewrite の Request からコピー元の Generation と Precondition を読み取る
+func parseSourceConditions(ar *apiRequest) (*conditions, error) {
+	return parseConditionParams(ar, sourceConditionParams)
+}
+
+func parseConditionParams(ar *apiRequest, params [5]conditionParam) (*conditions, error) {
+	c := &conditions{}
+	values := []**int64{&c.generation, &c.ifGenerationMatch, &c.ifGenerationNotMatch, &c.ifMetagenerationMatch, &c.ifMetagenerationNotMatch}
+	for i, p := range params {
+		s := ar.query.Get(p.name)
+		if s == "" && p.header != "" && ar.header != nil {
+			s = ar.header.Get(p.header)
+		}
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errInvalid(fmt.Sprintf("Invalid value for %s: %s", p.name, s))
+		}
+		*values[i] = &n
+	}
+	return c, nil
+}
+
+// selects is generation が指定されている場合に attrs がその Generation の Object かどうかを返す
+func (c *conditions) selects(attrs *apigcs.Object) bool {
+	if c == nil || c.generation == nil {
+		return true
+	}
+	return *c.generation == attrs.Generation
+}
+
+// checkMetageneration is Bucket の Metageneration に対して ifMetagenerationMatch, ifMetagenerationNotMatch を満たしているかを確認する
+func (c *conditions) checkMetageneration(metageneration int64) error {
+	if c == nil {
+		return nil
+	}
+	if c.ifMetagenerationMatch != nil && *c.ifMetagenerationMatch != metageneration {
+		return errPreconditionFailed()
+	}
+	if c.ifMetagenerationNotMatch != nil && *c.ifMetagenerationNotMatch == metageneration {
+		return errPreconditionFailed()
+	}
+	return nil
+}
+
+// check is 現在の Object に対して Precondition を満たしているかを確認する
+// attrs が nil の場合は Object が存在しないものとして扱い、ifGenerationMatch=0 だけを満たす
+func (c *conditions) check(attrs *apigcs.Object) error {
+	if c == nil {
+		return nil
+	}
+	var generation, metageneration int64
+	if attrs != nil {
+		generation = attrs.Generation
+		metageneration = attrs.Metageneration
+	}
+	if c.ifGenerationMatch != nil && *c.ifGenerationMatch != generation {
+		return errPreconditionFailed()
+	}
+	if c.ifGenerationNotMatch != nil && *c.ifGenerationNotMatch == generation {
+		return errPreconditionFailed()
+	}
+	if c.ifMetagenerationMatch != nil && (attrs == nil || *c.ifMetagenerationMatch != metageneration) {
+		return errPreconditionFailed()
+	}
+	if c.ifMetagenerationNotMatch != nil && attrs != nil && *c.ifMetagenerationNotMatch == metageneration {
+		return errPreconditionFailed()
+	}
+	return nil
+}
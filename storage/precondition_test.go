@@ -0,0 +1,103 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func assertPreconditionFailed(t *testing.T, err error) {
+	t.Helper()
+
+	assertStatusCode(t, err, http.StatusPreconditionFailed)
+}
+
+func writeObjectWithConditions(ctx context.Context, obj *storage.ObjectHandle, conds storage.Conditions, body string) (*storage.ObjectAttrs, error) {
+	w := obj.If(conds).NewWriter(ctx)
+	w.ContentType = "text/plain"
+	if _, err := w.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Attrs(), nil
+}
+
+func TestStatefulFaker_Preconditions(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+
+	t.Run("does not exist", func(t *testing.T) {
+		obj := stg.Bucket(bucket).Object("lock.txt")
+		if _, err := writeObjectWithConditions(ctx, obj, storage.Conditions{DoesNotExist: true}, "first"); err != nil {
+			t.Fatal(err)
+		}
+		_, err := writeObjectWithConditions(ctx, obj, storage.Conditions{DoesNotExist: true}, "second")
+		assertPreconditionFailed(t, err)
+		if e, g := "first", readObject(t, stg, bucket, "lock.txt"); e != g {
+			t.Errorf("want body %q but got %q", e, g)
+		}
+	})
+
+	t.Run("generation match", func(t *testing.T) {
+		obj := stg.Bucket(bucket).Object("generation.txt")
+		first := writeObject(t, stg, bucket, "generation.txt", "first")
+		second, err := writeObjectWithConditions(ctx, obj, storage.Conditions{GenerationMatch: first.Generation}, "second")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.Generation <= first.Generation {
+			t.Errorf("generation is not increased. %d -> %d", first.Generation, second.Generation)
+		}
+		_, err = writeObjectWithConditions(ctx, obj, storage.Conditions{GenerationMatch: first.Generation}, "third")
+		assertPreconditionFailed(t, err)
+
+		_, err = obj.If(storage.Conditions{GenerationMatch: first.Generation}).NewReader(ctx)
+		assertPreconditionFailed(t, err)
+		r, err := obj.If(storage.Conditions{GenerationMatch: second.Generation}).NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+
+		// 現在の Generation を指定した読み込みはできるが、存在しない Generation は見つからない
+		if _, err := obj.Generation(second.Generation).Attrs(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := obj.Generation(first.Generation).NewReader(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+			t.Errorf("want ErrObjectNotExist but got %v", err)
+		}
+	})
+
+	t.Run("metageneration match", func(t *testing.T) {
+		obj := stg.Bucket(bucket).Object("metageneration.txt")
+		attrs := writeObject(t, stg, bucket, "metageneration.txt", "body")
+		updated, err := obj.If(storage.Conditions{MetagenerationMatch: attrs.Metageneration}).Update(ctx, storage.ObjectAttrsToUpdate{ContentType: "text/csv"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := attrs.Metageneration+1, updated.Metageneration; e != g {
+			t.Errorf("want metageneration %d but got %d", e, g)
+		}
+		_, err = obj.If(storage.Conditions{MetagenerationMatch: attrs.Metageneration}).Update(ctx, storage.ObjectAttrsToUpdate{ContentType: "text/plain"})
+		assertPreconditionFailed(t, err)
+		_, err = obj.If(storage.Conditions{MetagenerationNotMatch: updated.Metageneration}).Update(ctx, storage.ObjectAttrsToUpdate{ContentType: "text/plain"})
+		assertPreconditionFailed(t, err)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		obj := stg.Bucket(bucket).Object("delete.txt")
+		attrs := writeObject(t, stg, bucket, "delete.txt", "body")
+		err := obj.If(storage.Conditions{GenerationNotMatch: attrs.Generation}).Delete(ctx)
+		assertPreconditionFailed(t, err)
+		if err := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// byteRange is Range Header で指定された範囲を Object の Size に合わせて確定させたもの
+type byteRange struct {
+	first int64
+	last  int64
+}
+
+// errRangeNotSatisfiable is Range の開始位置が Object の末尾よりも後ろにある
+var errRangeNotSatisfiable = &storeError{
+	code:    http.StatusRequestedRangeNotSatisfiable,
+	reason:  "requestedRangeNotSatisfiable",
+	message: "The requested range cannot be satisfied.",
+}
+
+// parseRange is "bytes=0-99", "bytes=100-", "bytes=-100" 形式の Range Header を size の Object に対する範囲にする
+//
+// Range が指定されていない場合や解釈できない場合は nil を返すので、Object 全体を返す
+// 開始位置が size 以上の場合は errRangeNotSatisfiable を返す
+func parseRange(v string, size int64) (*byteRange, error) {
+	spec := strings.TrimPrefix(strings.TrimSpace(v), "bytes=")
+	if spec == v || spec == "" || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, nil
+	}
+	if first == "" {
+		// suffix range は末尾から n byte
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		return &byteRange{first: size - n, last: size - 1}, nil
+	}
+	r := &byteRange{last: size - 1}
+	var err error
+	r.first, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || r.first < 0 {
+		return nil, nil
+	}
+	if last != "" {
+		r.last, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || r.last < r.first {
+			return nil, nil
+		}
+		if r.last > size-1 {
+			r.last = size - 1
+		}
+	}
+	if r.first >= size {
+		return nil, errRangeNotSatisfiable
+	}
+	return r, nil
+}
+
+func (r *byteRange) length() int64 {
+	return r.last - r.first + 1
+}
+
+func (r *byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.first, r.last, size)
+}
+
+// writeRangeNotSatisfiable is 416 を返す
+func writeRangeNotSatisfiable(w http.ResponseWriter, ar *apiRequest, size int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	writeError(w, ar, errRangeNotSatisfiable)
+}
+
+// applyRange is 登録された Object の読み込みの Response に Request の Range を適用する
+// 200 以外の Response や、Range が指定されていない Request の場合は res をそのまま返す
+func applyRange(req *http.Request, ar *apiRequest, res *http.Response) (*http.Response, error) {
+	if res.StatusCode != http.StatusOK || res.Body == nil || req.Header.Get("Range") == "" {
+		return res, nil
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(body))
+	r, err := parseRange(req.Header.Get("Range"), size)
+	if err != nil {
+		header := http.Header{}
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return newErrorResponse(ar, err, header), nil
+	}
+	if r == nil {
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		return res, nil
+	}
+	header := res.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Range", r.contentRange(size))
+	header.Set("Content-Length", strconv.FormatInt(r.length(), 10))
+	partial := newResponse(http.StatusPartialContent, header, body[r.first:r.last+1])
+	partial.Request = res.Request
+	return partial, nil
+}
@@ -0,0 +1,119 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func TestStatefulFaker_RangeReader(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "range.txt"
+	const body = "0123456789abcdefghij"
+	writeObject(t, stg, bucket, object, body)
+
+	cases := []struct {
+		name        string
+		offset      int64
+		length      int64
+		want        string
+		startOffset int64
+	}{
+		{"offset and length", 3, 5, "34567", 3},
+		{"offset to end", 15, -1, "fghij", 15},
+		{"length over end", 18, 10, "ij", 18},
+		{"suffix", -4, -1, "ghij", 16},
+		{"suffix over size", -100, -1, body, 0},
+	}
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := stg.Bucket(bucket).Object(object).NewRangeReader(ctx, tt.offset, tt.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, g := tt.want, string(got); e != g {
+				t.Errorf("want body %q but got %q", e, g)
+			}
+			if e, g := tt.startOffset, r.Attrs.StartOffset; e != g {
+				t.Errorf("want StartOffset %d but got %d", e, g)
+			}
+			if e, g := int64(len(body)), r.Attrs.Size; e != g {
+				t.Errorf("want Size %d but got %d", e, g)
+			}
+		})
+	}
+
+	t.Run("not satisfiable", func(t *testing.T) {
+		_, err := stg.Bucket(bucket).Object(object).NewRangeReader(ctx, int64(len(body)), 1)
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) {
+			t.Fatalf("want googleapi.Error but got %v", err)
+		}
+		if e, g := http.StatusRequestedRangeNotSatisfiable, gerr.Code; e != g {
+			t.Errorf("want status %d but got %d", e, g)
+		}
+	})
+}
+
+// TestFaker_RangeReaderWithGetObjectResponse is 登録した Response にも Range が適用されることを確認する
+func TestFaker_RangeReaderWithGetObjectResponse(t *testing.T) {
+	ctx := context.Background()
+
+	faker := storagefaker.NewFaker(t)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "range.txt"
+	for i := 0; i < 2; i++ {
+		res := storagefaker.GetObjectOKResponseSample()
+		res.Body = io.NopCloser(strings.NewReader("0123456789"))
+		res.Header["Content-Length"] = []string{"10"}
+		res.ContentLength = 10
+		if err := faker.AddGetObjectResponse(bucket, object, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := stg.Bucket(bucket).Object(object).NewRangeReader(ctx, -3, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if e, g := "789", string(got); e != g {
+		t.Errorf("want body %q but got %q", e, g)
+	}
+
+	_, err = stg.Bucket(bucket).Object(object).NewRangeReader(ctx, 20, 1)
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		t.Fatalf("want googleapi.Error but got %v", err)
+	}
+	if e, g := http.StatusRequestedRangeNotSatisfiable, gerr.Code; e != g {
+		t.Errorf("want status %d but got %d", e, g)
+	}
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// defaultMaxRecordedBodySize is Request の body と Upload の中身を記録する大きさの上限の初期値
+const defaultMaxRecordedBodySize = 32 << 20
+
+// RecordedRequest is Faker が受け取った Request
+// 登録された Response を返したか、stateful mode の store で処理したかに関係なく、全ての Request を記録する
+type RecordedRequest struct {
+	Method string
+	URL    *url.URL
+	Header http.Header
+
+	// Body is Request の body
+	// SetMaxRecordedBodySize の上限より大きい body は memory に載せないように記録せず、nil になる
+	// Resumable Upload の chunk の body も記録しないので nil になる
+	// chunk を繋げた中身は Uploads で確認できる
+	Body []byte
+
+	// Operation is Request を解釈した GCS の API の操作で、"objects.insert" など
+	// GCS の操作として解釈できない Request の場合は空
+	Operation string
+	Bucket    string
+	Object    string
+
+	// captured is 記録の時に読み込んだ body の先頭
+	// body が上限より大きい時も、Upload の metadata を解釈するために使う
+	captured []byte
+}
+
+// RecordedUpload is Object の Upload で Client が送ってきた metadata と中身
+//
+// uploadType=multipart の場合は multipart/related の body の metadata の JSON と media を、
+// XML API の PUT Object の場合は Header と body を、
+// uploadType=resumable の場合は全ての chunk が揃った時点の metadata と中身を記録する
+type RecordedUpload struct {
+	// Request is Upload を完了させた Request
+	// Resumable Upload の場合は最後の chunk の Request になる
+	Request *RecordedRequest
+
+	// Attrs is Client が送ってきた metadata
+	// Size は Upload された中身の大きさになる
+	// 上限より大きい uploadType=multipart などの Upload で大きさが分からない場合は 0 になる
+	Attrs *storage.ObjectAttrs
+
+	// Content is Upload された中身
+	// SetMaxRecordedBodySize の上限より大きい中身は記録せず、nil になる
+	Content []byte
+}
+
+// recorder is Faker が受け取った Request と Upload を受け取った順に保持する
+type recorder struct {
+	mu       sync.Mutex
+	requests []*RecordedRequest
+	uploads  []*RecordedUpload
+
+	// maxBodySize is body と中身を記録する大きさの上限
+	maxBodySize int64
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		maxBodySize: defaultMaxRecordedBodySize,
+	}
+}
+
+// SetMaxRecordedBodySize is Requests と Uploads で記録する body と中身の大きさの上限を変更する
+// 初期値は 32MiB で、上限より大きい body は記録しないので、大きな Object の Upload も memory に載せずに処理できる
+func (faker *Faker) SetMaxRecordedBodySize(n int64) {
+	rec := faker.transport.recorder
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.maxBodySize = n
+}
+
+func (rec *recorder) maxBody() int64 {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return rec.maxBodySize
+}
+
+// recordedRequestKey is Resumable Upload の完了時に、記録した Request を取り出すための context の key
+type recordedRequestKey struct{}
+
+// withRecordedRequest is 記録した Request を req の context に入れる
+func withRecordedRequest(req *http.Request, r *RecordedRequest) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), recordedRequestKey{}, r))
+}
+
+// recordedRequestOf is withRecordedRequest で入れた Request を返す
+func recordedRequestOf(req *http.Request) *RecordedRequest {
+	r, _ := req.Context().Value(recordedRequestKey{}).(*RecordedRequest)
+	return r
+}
+
+// record is Request を記録する
+// body は読み込んでしまうので、同じ内容を読める body に置き換える
+// 上限より大きい body は先頭だけを読み込み、残りは読まずに後ろに繋げる
+func (rec *recorder) record(req *http.Request, ar *apiRequest) (*RecordedRequest, error) {
+	var body, captured []byte
+	// Resumable Upload の chunk は大きな Object を分けて送るためのものなので、全て記録すると Object 全体を memory に載せてしまう
+	if req.Body != nil && ar.operation != operationResumableUpload {
+		max := rec.maxBody()
+		b, err := io.ReadAll(io.LimitReader(req.Body, max+1))
+		if err != nil {
+			return nil, err
+		}
+		captured = b
+		if int64(len(b)) <= max {
+			if err := req.Body.Close(); err != nil {
+				return nil, err
+			}
+			body = b
+			req.Body = io.NopCloser(bytes.NewReader(b))
+		} else {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		}
+	}
+	u := *req.URL
+	r := &RecordedRequest{
+		Method:    req.Method,
+		URL:       &u,
+		Header:    req.Header.Clone(),
+		Body:      body,
+		Operation: string(ar.operation),
+		Bucket:    ar.bucket,
+		Object:    ar.object,
+		captured:  captured,
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.requests = append(rec.requests, r)
+	return r, nil
+}
+
+// recordSimpleUpload is uploadType=multipart, uploadType=media, XML API の PUT Object の Upload を記録する
+// metadata を解釈できない Upload は記録しない
+// body が上限より大きい場合は、読み込んだ先頭から metadata だけを記録する
+func (rec *recorder) recordSimpleUpload(req *http.Request, ar *apiRequest, r *RecordedRequest) {
+	clone := req.Clone(req.Context())
+	clone.Body = io.NopCloser(bytes.NewReader(r.captured))
+	attrs, content, err := readUpload(clone, ar)
+	if err != nil {
+		return
+	}
+	if r.Body == nil && r.captured != nil {
+		var size int64
+		if ar.query.Get("uploadType") != "multipart" && req.ContentLength > 0 {
+			size = req.ContentLength
+		}
+		rec.recordUpload(r, ar, attrs, nil, size)
+		return
+	}
+	b, err := io.ReadAll(content)
+	if err != nil {
+		return
+	}
+	rec.recordUpload(r, ar, attrs, b, int64(len(b)))
+}
+
+// recordBlobUpload is Resumable Upload で全ての chunk が揃った時の metadata と中身を記録する
+// 中身は上限以下の大きさの時だけ読み込む
+func (rec *recorder) recordBlobUpload(r *RecordedRequest, ar *apiRequest, attrs *apigcs.Object, blob Blob) {
+	var content []byte
+	if blob.Size() <= rec.maxBody() {
+		b, err := readBlob(blob)
+		if err != nil {
+			return
+		}
+		content = b
+	}
+	rec.recordUpload(r, ar, attrs, content, blob.Size())
+}
+
+// recordUpload is 解釈済みの Upload の metadata と中身を記録する
+func (rec *recorder) recordUpload(r *RecordedRequest, ar *apiRequest, attrs *apigcs.Object, content []byte, size int64) {
+	oa := objectAttrsOf(attrs)
+	if oa.Bucket == "" {
+		oa.Bucket = ar.bucket
+	}
+	oa.Size = size
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.uploads = append(rec.uploads, &RecordedUpload{
+		Request: r,
+		Attrs:   oa,
+		Content: content,
+	})
+}
+
+// Requests is Faker が受け取った全ての Request を受け取った順に返す
+func (faker *Faker) Requests() []*RecordedRequest {
+	rec := faker.transport.recorder
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return append([]*RecordedRequest(nil), rec.requests...)
+}
+
+// Uploads is bucket の object への Upload を受け取った順に返す
+// Client が Retry した場合は、Retry した Upload も含む
+func (faker *Faker) Uploads(bucket string, object string) []*RecordedUpload {
+	rec := faker.transport.recorder
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	var l []*RecordedUpload
+	for _, u := range rec.uploads {
+		if u.Attrs.Bucket == bucket && u.Attrs.Name == object {
+			l = append(l, u)
+		}
+	}
+	return l
+}
+
+// objectAttrsOf is JSON API の Object の metadata を storage.ObjectAttrs にする
+// Upload の metadata で Client が送ってくる項目だけを変換する
+func objectAttrsOf(o *apigcs.Object) *storage.ObjectAttrs {
+	attrs := &storage.ObjectAttrs{
+		Bucket:             o.Bucket,
+		Name:               o.Name,
+		ContentType:        o.ContentType,
+		ContentLanguage:    o.ContentLanguage,
+		CacheControl:       o.CacheControl,
+		ContentEncoding:    o.ContentEncoding,
+		ContentDisposition: o.ContentDisposition,
+		Metadata:           o.Metadata,
+		StorageClass:       o.StorageClass,
+		KMSKeyName:         o.KmsKeyName,
+		EventBasedHold:     o.EventBasedHold,
+		TemporaryHold:      o.TemporaryHold,
+	}
+	if b, err := base64.StdEncoding.DecodeString(o.Md5Hash); err == nil && len(b) > 0 {
+		attrs.MD5 = b
+	}
+	if b, err := base64.StdEncoding.DecodeString(o.Crc32c); err == nil && len(b) == 4 {
+		attrs.CRC32C = binary.BigEndian.Uint32(b)
+	}
+	if t, err := time.Parse(time.RFC3339, o.CustomTime); err == nil {
+		attrs.CustomTime = t
+	}
+	for _, rule := range o.Acl {
+		if rule == nil {
+			continue
+		}
+		attrs.ACL = append(attrs.ACL, storage.ACLRule{
+			Entity: storage.ACLEntity(rule.Entity),
+			Role:   storage.ACLRole(rule.Role),
+		})
+	}
+	return attrs
+}
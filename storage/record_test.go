@@ -0,0 +1,135 @@
+package storage_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func TestFaker_Uploads(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+	const object = "dir/hello.txt"
+	const body = "Hello Upload"
+
+	faker := storagefaker.NewFaker(t)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := storagefaker.GenerateSimplePostObjectOKResponse(bucket, object, "text/plain", uint64(len(body)))
+	if err := faker.AddPostObjectOKResponse(bucket, object, make(map[string][]string), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	w := stg.Bucket(bucket).Object(object).NewWriter(ctx)
+	w.ContentType = "text/plain"
+	w.CacheControl = "no-cache"
+	w.Metadata = map[string]string{"owner": "sinmetal"}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := faker.Uploads(bucket, object)
+	if e, g := 1, len(uploads); e != g {
+		t.Fatalf("want %d uploads but got %d", e, g)
+	}
+	got := uploads[0]
+	if e, g := body, string(got.Content); e != g {
+		t.Errorf("want content %q but got %q", e, g)
+	}
+	if e, g := "text/plain", got.Attrs.ContentType; e != g {
+		t.Errorf("want ContentType %q but got %q", e, g)
+	}
+	if e, g := "no-cache", got.Attrs.CacheControl; e != g {
+		t.Errorf("want CacheControl %q but got %q", e, g)
+	}
+	if e, g := map[string]string{"owner": "sinmetal"}, got.Attrs.Metadata; !cmp.Equal(e, g) {
+		t.Errorf("unexpected Metadata %s", cmp.Diff(e, g))
+	}
+	if e, g := int64(len(body)), got.Attrs.Size; e != g {
+		t.Errorf("want Size %d but got %d", e, g)
+	}
+	if e, g := "objects.insert", got.Request.Operation; e != g {
+		t.Errorf("want operation %q but got %q", e, g)
+	}
+	if !strings.HasPrefix(got.Request.Header.Get("Content-Type"), "multipart/related") {
+		t.Errorf("unexpected Content-Type %q", got.Request.Header.Get("Content-Type"))
+	}
+	if e, g := 0, len(faker.Uploads(bucket, "other.txt")); e != g {
+		t.Errorf("want %d uploads but got %d", e, g)
+	}
+}
+
+func TestStatefulFaker_ResumableUploadIsRecorded(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+	const object = "dir/large.txt"
+
+	faker, stg := newStatefulClient(t)
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Repeat("a", 256*1024+10)
+	w := stg.Bucket(bucket).Object(object).NewWriter(ctx)
+	w.ChunkSize = 256 * 1024
+	w.ContentType = "text/plain"
+	w.Metadata = map[string]string{"chunked": "true"}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := faker.Uploads(bucket, object)
+	if e, g := 1, len(uploads); e != g {
+		t.Fatalf("want %d uploads but got %d", e, g)
+	}
+	if e, g := body, string(uploads[0].Content); e != g {
+		t.Errorf("want content length %d but got %d", len(e), len(g))
+	}
+	if e, g := "true", uploads[0].Attrs.Metadata["chunked"]; e != g {
+		t.Errorf("want metadata %q but got %q", e, g)
+	}
+	if e, g := "bytes 262144-262153/262154", uploads[0].Request.Header.Get("Content-Range"); e != g {
+		t.Errorf("want last chunk Content-Range %q but got %q", e, g)
+	}
+}
+
+func TestFaker_Requests(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+
+	faker, stg := newStatefulClient(t)
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeObject(t, stg, bucket, "hello.txt", "Hello")
+	if e, g := "Hello", readObject(t, stg, bucket, "hello.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+
+	var got []string
+	for _, r := range faker.Requests() {
+		got = append(got, r.Operation+" "+r.Bucket+" "+r.Object)
+	}
+	e := []string{
+		"buckets.insert  ",
+		"objects.insert sinmetal-ci-fake hello.txt",
+		"objects.download sinmetal-ci-fake hello.txt",
+	}
+	if !cmp.Equal(e, got) {
+		t.Errorf("unexpected requests %s", cmp.Diff(e, got))
+	}
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// operation is GCS の API の操作の種類
+// JSON API の method 名に合わせているが、Object の中身の読み込みは objects.get と区別するために objects.download としている
+type operation string
+
+const (
+	operationUnknown        operation = ""
+	operationInsertObject   operation = "objects.insert"
+	operationGetObject      operation = "objects.get"
+	operationDownloadObject operation = "objects.download"
+	operationPatchObject    operation = "objects.patch"
+	operationUpdateObject   operation = "objects.update"
+	operationDeleteObject   operation = "objects.delete"
+	operationListObjects    operation = "objects.list"
+	operationComposeObject  operation = "objects.compose"
+	operationRewriteObject  operation = "objects.rewrite"
+
+	operationInsertBucket operation = "buckets.insert"
+	operationGetBucket    operation = "buckets.get"
+	operationPatchBucket  operation = "buckets.patch"
+	operationDeleteBucket operation = "buckets.delete"
+	operationListBuckets  operation = "buckets.list"
+
+	operationLockRetentionPolicy operation = "buckets.lockRetentionPolicy"
+
+	// operationResumableUpload is objects.insert で開始した Resumable Upload の Session に対する Request
+	operationResumableUpload operation = "objects.insert.resumable"
+)
+
+// apiRequest is http.Request を GCS の API の操作として解釈したもの
+type apiRequest struct {
+	operation operation
+	method    string
+	bucket    string
+	object    string
+
+	// acl is ACL への Request の場合の ACL の種類
+	acl aclResource
+
+	// entity is ACL の rule の Entity
+	// ACL の一覧と追加の Request の場合は空
+	entity string
+
+	// destinationBucket, destinationObject is objects.rewrite のコピー先
+	// bucket, object はコピー元になる
+	destinationBucket string
+	destinationObject string
+
+	// xml is XML API への Request の場合 true
+	xml bool
+
+	query  url.Values
+	header http.Header
+}
+
+// parseRequest is http.Request の Method と Path から GCS の API の操作を判定する
+// Host は見ていないので、storage.googleapis.com, www.googleapis.com, Emulator の Host のどれに来た Request でも同じように解釈する
+func parseRequest(req *http.Request) *apiRequest {
+	ar := &apiRequest{
+		method: req.Method,
+		query:  req.URL.Query(),
+		header: req.Header,
+	}
+	segments := splitPath(req.URL)
+	switch {
+	case hasPrefixSegments(segments, "storage", "v1"):
+		ar.parseJSONAPI(segments[2:])
+	case hasPrefixSegments(segments, "download", "storage", "v1"):
+		// MediaLink の URL で、alt=media の objects.get と同じ
+		ar.parseJSONAPI(segments[3:])
+	case hasPrefixSegments(segments, "upload", "storage", "v1"):
+		ar.parseUploadAPI(segments[3:])
+	default:
+		ar.parseXMLAPI(segments)
+	}
+	return ar
+}
+
+// parseJSONAPI is /storage/v1 以下の Path を解釈する
+func (ar *apiRequest) parseJSONAPI(segments []string) {
+	if len(segments) == 0 || segments[0] != "b" {
+		return
+	}
+	if len(segments) == 1 {
+		switch ar.method {
+		case http.MethodPost:
+			ar.operation = operationInsertBucket
+		case http.MethodGet:
+			ar.operation = operationListBuckets
+		}
+		return
+	}
+	ar.bucket = segments[1]
+	segments = segments[2:]
+	if len(segments) > 0 && segments[0] == "acl" {
+		ar.parseACL(aclResourceBucket, segments[1:])
+		return
+	}
+	if len(segments) > 0 && segments[0] == "defaultObjectAcl" {
+		ar.parseACL(aclResourceDefaultObject, segments[1:])
+		return
+	}
+	if len(segments) == 0 {
+		switch ar.method {
+		case http.MethodGet:
+			ar.operation = operationGetBucket
+		case http.MethodPatch:
+			ar.operation = operationPatchBucket
+		case http.MethodDelete:
+			ar.operation = operationDeleteBucket
+		}
+		return
+	}
+	if len(segments) == 1 && segments[0] == "lockRetentionPolicy" {
+		if ar.method == http.MethodPost {
+			ar.operation = operationLockRetentionPolicy
+		}
+		return
+	}
+	if segments[0] != "o" {
+		return
+	}
+	switch len(segments) {
+	case 1:
+		if ar.method == http.MethodGet {
+			ar.operation = operationListObjects
+		}
+	case 2:
+		ar.object = segments[1]
+		switch ar.method {
+		case http.MethodGet:
+			if ar.query.Get("alt") == "media" {
+				ar.operation = operationDownloadObject
+			} else {
+				ar.operation = operationGetObject
+			}
+		case http.MethodPatch:
+			ar.operation = operationPatchObject
+		case http.MethodPut:
+			ar.operation = operationUpdateObject
+		case http.MethodDelete:
+			ar.operation = operationDeleteObject
+		}
+	case 3, 4:
+		ar.object = segments[1]
+		switch {
+		case segments[2] == "acl":
+			ar.parseACL(aclResourceObject, segments[3:])
+		case segments[2] == "compose" && len(segments) == 3 && ar.method == http.MethodPost:
+			ar.operation = operationComposeObject
+		}
+	case 7:
+		// /b/{sourceBucket}/o/{sourceObject}/rewriteTo/b/{destinationBucket}/o/{destinationObject}
+		ar.object = segments[1]
+		if segments[2] == "rewriteTo" && segments[3] == "b" && segments[5] == "o" && ar.method == http.MethodPost {
+			ar.operation = operationRewriteObject
+			ar.destinationBucket = segments[4]
+			ar.destinationObject = segments[6]
+		}
+	}
+}
+
+// parseACL is acl, defaultObjectAcl より後ろの Path を解釈する
+// operation は objectAccessControls.list のように JSON API の method 名にする
+func (ar *apiRequest) parseACL(resource aclResource, segments []string) {
+	if len(segments) > 1 {
+		return
+	}
+	if len(segments) == 1 {
+		ar.entity = segments[0]
+	}
+	var method string
+	switch ar.method {
+	case http.MethodGet:
+		method = "get"
+		if ar.entity == "" {
+			method = "list"
+		}
+	case http.MethodPost:
+		method = "insert"
+	case http.MethodPut:
+		method = "update"
+	case http.MethodPatch:
+		method = "patch"
+	case http.MethodDelete:
+		method = "delete"
+	default:
+		return
+	}
+	ar.acl = resource
+	ar.operation = operation(fmt.Sprintf("%s.%s", resource, method))
+}
+
+// parseUploadAPI is /upload/storage/v1 以下の Path を解釈する
+func (ar *apiRequest) parseUploadAPI(segments []string) {
+	if len(segments) != 3 || segments[0] != "b" || segments[2] != "o" {
+		return
+	}
+	ar.bucket = segments[1]
+	ar.object = ar.query.Get("name")
+	if ar.query.Get("upload_id") != "" {
+		switch ar.method {
+		case http.MethodPut, http.MethodPost, http.MethodDelete:
+			ar.operation = operationResumableUpload
+		}
+		return
+	}
+	if ar.method == http.MethodPost {
+		ar.operation = operationInsertObject
+	}
+}
+
+// parseXMLAPI is /{bucket}/{object} 形式の XML API の Path を解釈する
+// Object 名に含まれる / は escape されずにそのまま Path に入ってくる
+func (ar *apiRequest) parseXMLAPI(segments []string) {
+	if len(segments) < 2 {
+		return
+	}
+	ar.xml = true
+	ar.bucket = segments[0]
+	ar.object = strings.Join(segments[1:], "/")
+	switch ar.method {
+	case http.MethodGet, http.MethodHead:
+		ar.operation = operationDownloadObject
+	case http.MethodPut:
+		ar.operation = operationInsertObject
+	case http.MethodDelete:
+		ar.operation = operationDeleteObject
+	}
+}
+
+// splitPath is escape されたままの Path を / で分割して、それぞれを unescape する
+// JSON API では Object 名に含まれる / が %2F に escape されているので、unescape 後の Path を分割すると Object 名が壊れてしまう
+func splitPath(u *url.URL) []string {
+	var segments []string
+	for _, s := range strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/") {
+		v, err := url.PathUnescape(s)
+		if err != nil {
+			v = s
+		}
+		segments = append(segments, v)
+	}
+	if len(segments) == 1 && segments[0] == "" {
+		return nil
+	}
+	return segments
+}
+
+func hasPrefixSegments(segments []string, prefix ...string) bool {
+	if len(segments) < len(prefix) {
+		return false
+	}
+	for i, v := range prefix {
+		if segments[i] != v {
+			return false
+		}
+	}
+	return true
+}
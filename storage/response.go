@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ResponseBuilder is 登録した Response を Request ごとに新しく作る
+//
+// http.Response の Body は1回しか読めないので、同じ Response を何度も返す場合や、
+// Client が Retry した時にも同じ内容を返したい場合は ResponseBuilder で登録する
+type ResponseBuilder interface {
+	Build(req *http.Request) (*http.Response, error)
+}
+
+// ResponseBuilderFunc is 関数を ResponseBuilder として使う
+type ResponseBuilderFunc func(req *http.Request) (*http.Response, error)
+
+// Build is f(req) を返す
+func (f ResponseBuilderFunc) Build(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// StaticResponse is StatusCode, Header, Body から毎回同じ内容の Response を作る ResponseBuilder
+type StaticResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+var _ ResponseBuilder = &StaticResponse{}
+
+// NewStaticResponse is res の Body を読み込んで、res と同じ内容の Response を何度でも作れる StaticResponse にする
+// 同じ res を何度渡しても同じ内容になるように、読み込んだ後の res の Body は同じ内容を読める Body に置き換える
+func NewStaticResponse(res *http.Response) (*StaticResponse, error) {
+	s := &StaticResponse{
+		StatusCode: res.StatusCode,
+		Header:     res.Header.Clone(),
+	}
+	if res.Body != nil {
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed read response body : %w", err)
+		}
+		if err := res.Body.Close(); err != nil {
+			return nil, err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(b))
+		s.Body = b
+	}
+	return s, nil
+}
+
+// Build is StaticResponse の内容で新しい Response を作る
+// StatusCode を指定していない場合は 200 になる
+func (s *StaticResponse) Build(req *http.Request) (*http.Response, error) {
+	code := s.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	header := s.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(s.Body)),
+		ContentLength: int64(len(s.Body)),
+		Request:       req,
+	}, nil
+}
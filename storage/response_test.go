@@ -0,0 +1,69 @@
+package storage_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+const helloURL = "https://storage.googleapis.com/sinmetal-ci-fake/hello.txt"
+
+func TestAddResponse_SameResponseTwice(t *testing.T) {
+	faker := storagefaker.NewFaker(t)
+	res := newTextResponse("Hello")
+	for i := 0; i < 2; i++ {
+		if err := faker.AddResponse(helloURL, http.MethodGet, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if e, g := "Hello", getBody(t, faker.Client, helloURL); e != g {
+			t.Errorf("%d : want %q but got %q", i, e, g)
+		}
+	}
+}
+
+func TestAlwaysRespond(t *testing.T) {
+	faker := storagefaker.NewFaker(t)
+	always := &storagefaker.StaticResponse{
+		Header: http.Header{"Content-Type": []string{"text/plain"}},
+		Body:   []byte("always"),
+	}
+	if err := faker.AlwaysRespond(helloURL, http.MethodGet, always); err != nil {
+		t.Fatal(err)
+	}
+	// 1回だけ返す Response は always よりも先に返す
+	if err := faker.AddResponseBuilder(helloURL, http.MethodGet, &storagefaker.StaticResponse{Body: []byte("once")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, e := range []string{"once", "always", "always", "always"} {
+		if g := getBody(t, faker.Client, helloURL); e != g {
+			t.Errorf("%d : want %q but got %q", i, e, g)
+		}
+	}
+}
+
+func TestAlwaysRespondWithMatcher(t *testing.T) {
+	faker := storagefaker.NewFaker(t)
+	var count int
+	builder := storagefaker.ResponseBuilderFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		return (&storagefaker.StaticResponse{Body: []byte(fmt.Sprintf("%s %d", req.URL.Path, count))}).Build(req)
+	})
+	err := faker.AlwaysRespondWithMatcher(func(req *http.Request) bool {
+		return req.Method == http.MethodGet
+	}, builder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, g := "/sinmetal-ci-fake/hello.txt 1", getBody(t, faker.Client, helloURL); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	if e, g := "/sinmetal-ci-fake/other.txt 2", getBody(t, faker.Client, "https://storage.googleapis.com/sinmetal-ci-fake/other.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+}
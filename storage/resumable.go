@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// uploadCompleter is Resumable Upload の全ての chunk が揃った時に Object を作成して Response を返す
+// req は最後の chunk の Request で、ar は Session を開始した Request
+// blob は全ての chunk を繋げた中身で、h はその objectHash
+type uploadCompleter func(req *http.Request, ar *apiRequest, attrs *apigcs.Object, blob *storedBlob, h *objectHash) (*http.Response, error)
+
+// resumableUploads is uploadType=resumable の Upload Session を管理する
+//
+// Session の開始 (POST uploadType=resumable) に対して upload_id を含んだ Location を返し、
+// Location に Content-Range 付きで送られてくる chunk を順番に繋げていく
+// 全ての chunk が揃ったら uploadCompleter で Object を作成する
+// chunk は memory に溜めずに backend に書き込んでいく
+type resumableUploads struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+
+	backend Backend
+}
+
+type uploadSession struct {
+	// mu is 同じ Session の chunk を順番に処理する
+	// 別の Session の chunk は並行に処理できる
+	mu sync.Mutex
+
+	// start is Session を開始した Request
+	// Bucket や ifGenerationMatch などの Precondition はこの Request で指定される
+	start *apiRequest
+
+	attrs *apigcs.Object
+
+	// backend is chunk を書き込む Backend
+	backend Backend
+
+	// w is 受け取った chunk を書き込む先で、hash は書き込んだ中身の Hash を計算する
+	// 最初の chunk を受け取るまでは nil で、完了した後も nil に戻す
+	w    BlobWriter
+	hash *hashingWriter
+
+	// received is 受け取り済みの byte 数
+	received int64
+
+	// blob, digest is 全ての chunk が揃って w を Commit した後の中身と、その objectHash
+	// Object の作成に失敗して最後の chunk が送り直された時にも、同じ中身を使う
+	blob   *storedBlob
+	digest *objectHash
+
+	// size is Client から通知された Object 全体の Size
+	// 最後の chunk が来るまでは分からないので -1
+	size int64
+
+	// result is Object の作成が終わった後の Response
+	// 完了後に Status を問い合わせられた時に同じ Response を返す
+	result *bufferedResponse
+}
+
+// bufferedResponse is 何度でも http.Response を作り直せるように body を []byte で保持した Response
+type bufferedResponse struct {
+	code   int
+	header http.Header
+	body   []byte
+}
+
+func newResumableUploads(backend Backend) *resumableUploads {
+	return &resumableUploads{
+		sessions: make(map[string]*uploadSession),
+		backend:  backend,
+	}
+}
+
+// roundTrip is Resumable Upload の Request を処理する
+func (u *resumableUploads) roundTrip(req *http.Request, ar *apiRequest, complete uploadCompleter) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if ar.operation == operationInsertObject {
+		return u.start(req, ar)
+	}
+	return u.upload(req, ar, complete)
+}
+
+// start is Upload Session を開始して、chunk を送る先を Location Header で返す
+func (u *resumableUploads) start(req *http.Request, ar *apiRequest) (*http.Response, error) {
+	attrs := &apigcs.Object{}
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, attrs); err != nil {
+			return newErrorResponse(ar, errInvalid(err.Error()), nil), nil
+		}
+	}
+	if ar.object != "" {
+		attrs.Name = ar.object
+	}
+	if attrs.ContentType == "" {
+		attrs.ContentType = req.Header.Get("X-Upload-Content-Type")
+	}
+
+	id := uuid.New().String()
+	u.mu.Lock()
+	u.sessions[id] = &uploadSession{
+		start:   ar,
+		attrs:   attrs,
+		backend: u.backend,
+		size:    -1,
+	}
+	u.mu.Unlock()
+
+	location := *req.URL
+	if location.Scheme == "" {
+		location.Scheme = "http"
+		if req.TLS != nil {
+			location.Scheme = "https"
+		}
+	}
+	if location.Host == "" {
+		location.Host = req.Host
+	}
+	q := location.Query()
+	q.Set("upload_id", id)
+	location.RawQuery = q.Encode()
+
+	header := http.Header{}
+	header.Set("Location", location.String())
+	header.Set("X-Guploader-Uploadid", id)
+	return newResponse(http.StatusOK, header, nil), nil
+}
+
+// upload is Upload Session に対する chunk の送信、Status の問い合わせ、Cancel を処理する
+func (u *resumableUploads) upload(req *http.Request, ar *apiRequest, complete uploadCompleter) (*http.Response, error) {
+	id := ar.query.Get("upload_id")
+
+	u.mu.Lock()
+	session, ok := u.sessions[id]
+	if ok && req.Method == http.MethodDelete {
+		delete(u.sessions, id)
+	}
+	u.mu.Unlock()
+	if !ok {
+		return newErrorResponse(ar, &storeError{
+			code:    http.StatusNotFound,
+			reason:  "notFound",
+			message: fmt.Sprintf("No such upload session: %s", id),
+		}, nil), nil
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if req.Method == http.MethodDelete {
+		if session.w != nil && session.blob == nil {
+			_ = session.w.Abort()
+		}
+		session.release()
+		return newResponse(499, http.Header{}, nil), nil
+	}
+	if session.result != nil {
+		return session.result.response(), nil
+	}
+
+	cr, err := parseContentRange(req.Header.Get("Content-Range"))
+	if err != nil {
+		return newErrorResponse(ar, errInvalid(err.Error()), nil), nil
+	}
+	if cr.hasData {
+		if cr.first > session.received {
+			// 途中の chunk が抜けているので、受け取り済みの範囲を返して送り直してもらう
+			return resumeIncompleteResponse(req, session.received), nil
+		}
+		if err := session.write(req.Body, cr); err != nil {
+			return newErrorResponse(ar, err, nil), nil
+		}
+	}
+	if cr.size >= 0 {
+		if session.received > cr.size {
+			return newErrorResponse(ar, errInvalid(fmt.Sprintf("received %d bytes but object size is %d", session.received, cr.size)), nil), nil
+		}
+		session.size = cr.size
+	}
+	if session.size < 0 || session.received < session.size {
+		return resumeIncompleteResponse(req, session.received), nil
+	}
+
+	if session.blob == nil {
+		if err := session.open(); err != nil {
+			return nil, err
+		}
+		blob, err := session.w.Commit()
+		if err != nil {
+			return nil, err
+		}
+		session.blob = newStoredBlob(blob)
+		session.digest = session.hash.sum()
+	}
+	res, err := complete(req, session.start, session.attrs, session.blob, session.digest)
+	if err != nil {
+		return nil, err
+	}
+	result, err := newBufferedResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	if result.code >= 200 && result.code < 300 {
+		// 完了した後は Status の問い合わせに result を返すだけなので、中身は Object に任せて Session からは手放す
+		// 登録された Response を返して Object を作成しなかった場合は、ここで中身が Release される
+		session.result = result
+		session.release()
+	}
+	return result.response(), nil
+}
+
+// open is 最初の chunk を受け取った時に、chunk を書き込む BlobWriter を作成する
+func (session *uploadSession) open() error {
+	if session.w != nil {
+		return nil
+	}
+	w, err := session.backend.NewBlob()
+	if err != nil {
+		return err
+	}
+	session.w = w
+	session.hash = newHashingWriter()
+	return nil
+}
+
+// release is Session が持っている中身への参照を手放す
+func (session *uploadSession) release() {
+	if session.blob != nil {
+		session.blob.drop()
+	}
+	session.w = nil
+	session.hash = nil
+	session.blob = nil
+	session.digest = nil
+}
+
+// write is chunk の body の中で、まだ受け取っていない部分を backend に書き込む
+// 送り直された chunk で受け取り済みの部分は読み飛ばす
+func (session *uploadSession) write(body io.Reader, cr *contentRange) error {
+	if err := session.open(); err != nil {
+		return err
+	}
+	length := cr.last - cr.first + 1
+	skip := session.received - cr.first
+	if skip > length {
+		skip = length
+	}
+	if _, err := io.CopyN(io.Discard, body, skip); err != nil {
+		return errInvalid(fmt.Sprintf("Content-Range %d-%d does not match body length : %v", cr.first, cr.last, err))
+	}
+	n, err := io.CopyN(io.MultiWriter(session.w, session.hash), body, length-skip)
+	session.received += n
+	if err != nil {
+		return errInvalid(fmt.Sprintf("Content-Range %d-%d does not match body length : %v", cr.first, cr.last, err))
+	}
+	if extra, _ := io.Copy(io.Discard, body); extra > 0 {
+		return errInvalid(fmt.Sprintf("Content-Range %d-%d does not match body length %d", cr.first, cr.last, length+extra))
+	}
+	return nil
+}
+
+// resumeIncompleteResponse is まだ全ての chunk が揃っていないことを示す Response を返す
+// Client が X-GUploader-No-308 を送ってきている場合は 308 の代わりに 200 と X-Http-Status-Code-Override を返す
+func resumeIncompleteResponse(req *http.Request, received int64) *http.Response {
+	header := http.Header{}
+	if received > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+	if strings.EqualFold(req.Header.Get("X-GUploader-No-308"), "yes") {
+		header.Set("X-Http-Status-Code-Override", "308")
+		return newResponse(http.StatusOK, header, nil)
+	}
+	return newResponse(http.StatusPermanentRedirect, header, nil)
+}
+
+// contentRange is chunk の Request の Content-Range Header の内容
+type contentRange struct {
+	// hasData is chunk に data が含まれている場合 true
+	// "bytes */100" や "bytes */*" の場合は false
+	hasData bool
+	first   int64
+	last    int64
+
+	// size is Object 全体の Size で、"*" の場合は -1
+	size int64
+}
+
+// parseContentRange is "bytes 0-99/*", "bytes 100-199/200", "bytes */200", "bytes */*" 形式の Content-Range を解釈する
+func parseContentRange(v string) (*contentRange, error) {
+	if v == "" {
+		return &contentRange{size: -1}, nil
+	}
+	spec := strings.TrimPrefix(v, "bytes ")
+	if spec == v {
+		return nil, fmt.Errorf("invalid Content-Range %q", v)
+	}
+	i := strings.Index(spec, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid Content-Range %q", v)
+	}
+	cr := &contentRange{size: -1}
+	if s := spec[i+1:]; s != "*" {
+		size, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-Range %q : %w", v, err)
+		}
+		cr.size = size
+	}
+	if r := spec[:i]; r != "*" {
+		first, last, ok := strings.Cut(r, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid Content-Range %q", v)
+		}
+		var err error
+		cr.first, err = strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-Range %q : %w", v, err)
+		}
+		cr.last, err = strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-Range %q : %w", v, err)
+		}
+		if cr.last < cr.first {
+			return nil, fmt.Errorf("invalid Content-Range %q", v)
+		}
+		cr.hasData = true
+	}
+	return cr, nil
+}
+
+// isResumableUpload is Resumable Upload の Session の開始か、Session に対する Request の場合 true を返す
+func (ar *apiRequest) isResumableUpload() bool {
+	switch ar.operation {
+	case operationInsertObject:
+		return ar.query.Get("uploadType") == "resumable"
+	case operationResumableUpload:
+		return true
+	}
+	return false
+}
+
+func newBufferedResponse(res *http.Response) (*bufferedResponse, error) {
+	var body []byte
+	if res.Body != nil {
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	return &bufferedResponse{
+		code:   res.StatusCode,
+		header: res.Header.Clone(),
+		body:   body,
+	}, nil
+}
+
+func (r *bufferedResponse) response() *http.Response {
+	return newResponse(r.code, r.header.Clone(), r.body)
+}
+
+// newResponse is 指定した Status Code, Header, body の http.Response を作る
+func newResponse(code int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
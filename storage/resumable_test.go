@@ -0,0 +1,228 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func TestStatefulFaker_ResumableUpload(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	cases := []struct {
+		name string
+		size int
+	}{
+		{"just chunk size", googleapi.MinUploadChunkSize},
+		{"multi chunk", googleapi.MinUploadChunkSize*2 + 100},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			object := fmt.Sprintf("big-%d.bin", tt.size)
+			want := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+
+			w := stg.Bucket(bucket).Object(object).NewWriter(ctx)
+			w.ChunkSize = googleapi.MinUploadChunkSize
+			w.ContentType = "application/octet-stream"
+			if _, err := w.Write(want); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if e, g := int64(tt.size), w.Attrs().Size; e != g {
+				t.Errorf("want size %d but got %d", e, g)
+			}
+			if got := readObject(t, stg, bucket, object); got != string(want) {
+				t.Errorf("unexpected body. len want %d but got %d", len(want), len(got))
+			}
+		})
+	}
+}
+
+// TestFaker_ResumableUploadWithPostObjectOKResponse is Response を登録する mode でも Resumable Upload ができることを確認する
+func TestFaker_ResumableUploadWithPostObjectOKResponse(t *testing.T) {
+	ctx := context.Background()
+
+	faker := storagefaker.NewFaker(t)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "big.bin"
+	size := googleapi.MinUploadChunkSize*2 + 1
+	resp := storagefaker.GenerateSimplePostObjectOKResponse(bucket, object, "application/octet-stream", uint64(size))
+	if err := faker.AddPostObjectOKResponse(bucket, object, make(map[string][]string), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	w := stg.Bucket(bucket).Object(object).NewWriter(ctx)
+	w.ChunkSize = googleapi.MinUploadChunkSize
+	if _, err := w.Write(bytes.Repeat([]byte("a"), size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int64(size), w.Attrs().Size; e != g {
+		t.Errorf("want size %d but got %d", e, g)
+	}
+}
+
+// TestStatefulFaker_ResumableUploadProtocol is Client Library を使わずに Resumable Upload の Session を操作する
+func TestStatefulFaker_ResumableUploadProtocol(t *testing.T) {
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "protocol.txt"
+
+	start := func(t *testing.T) string {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s", bucket, object), strings.NewReader(`{"contentType":"text/plain"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := faker.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if e, g := http.StatusOK, res.StatusCode; e != g {
+			t.Fatalf("want status %d but got %d", e, g)
+		}
+		location := res.Header.Get("Location")
+		if !strings.Contains(location, "upload_id=") {
+			t.Fatalf("unexpected Location %s", location)
+		}
+		return location
+	}
+	put := func(t *testing.T, location string, contentRange string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, location, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Range", contentRange)
+		res, err := faker.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	t.Run("chunks", func(t *testing.T) {
+		location := start(t)
+
+		res := put(t, location, "bytes 0-4/*", "hello")
+		if e, g := http.StatusPermanentRedirect, res.StatusCode; e != g {
+			t.Errorf("want status %d but got %d", e, g)
+		}
+		if e, g := "bytes=0-4", res.Header.Get("Range"); e != g {
+			t.Errorf("want Range %s but got %s", e, g)
+		}
+
+		// 抜けがある chunk は受け付けずに、受け取り済みの範囲を返す
+		res = put(t, location, "bytes 8-10/11", "rld")
+		if e, g := "bytes=0-4", res.Header.Get("Range"); e != g {
+			t.Errorf("want Range %s but got %s", e, g)
+		}
+
+		// Status の問い合わせ
+		res = put(t, location, "bytes */*", "")
+		if e, g := http.StatusPermanentRedirect, res.StatusCode; e != g {
+			t.Errorf("want status %d but got %d", e, g)
+		}
+		if e, g := "bytes=0-4", res.Header.Get("Range"); e != g {
+			t.Errorf("want Range %s but got %s", e, g)
+		}
+
+		// 一部が送信済みの chunk を送り直しても重複しない
+		res = put(t, location, "bytes 3-10/11", "lo world")
+		if e, g := http.StatusOK, res.StatusCode; e != g {
+			t.Errorf("want status %d but got %d", e, g)
+		}
+		if e, g := "hello world", readObject(t, stg, bucket, object); e != g {
+			t.Errorf("want body %q but got %q", e, g)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		location := start(t)
+
+		req, err := http.NewRequest(http.MethodDelete, location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := faker.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if e, g := 499, res.StatusCode; e != g {
+			t.Errorf("want status %d but got %d", e, g)
+		}
+
+		res = put(t, location, "bytes 0-4/5", "hello")
+		if e, g := http.StatusNotFound, res.StatusCode; e != g {
+			t.Errorf("want status %d but got %d", e, g)
+		}
+	})
+}
+
+// TestStatefulFaker_CompletedResumableUploadReleasesContent is 完了した Upload Session が中身を持ち続けないことを確認する
+// Object を削除した後に、Upload した中身が memory に残っていないかを heap の大きさで確認する
+func TestStatefulFaker_CompletedResumableUploadReleasesContent(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+	// Uploads で中身を記録する上限よりも大きくする
+	const size = 40 << 20
+
+	faker, stg := newStatefulClient(t)
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	buf := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	obj := stg.Bucket(bucket).Object("large.bin")
+	w := obj.NewWriter(ctx)
+	w.ChunkSize = 8 << 20
+	for written := 0; written < size; written += len(buf) {
+		if _, err := w.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if growth := int64(after.HeapAlloc) - int64(before.HeapAlloc); growth > size/2 {
+		t.Errorf("heap grew %d bytes after uploading and deleting %d bytes", growth, size)
+	}
+	// 計測が終わるまで Faker が GC されないようにする
+	runtime.KeepAlive(faker)
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+func errRetentionPolicyNotMet(message string) error {
+	return &storeError{
+		code:    http.StatusForbidden,
+		reason:  "retentionPolicyNotMet",
+		message: message,
+	}
+}
+
+func errRetentionPolicyLocked(bucket string) error {
+	return &storeError{
+		code:    http.StatusForbidden,
+		reason:  "forbidden",
+		message: fmt.Sprintf("Cannot reduce retention duration or remove the locked Retention Policy for bucket '%s'.", bucket),
+	}
+}
+
+// checkRetention is Object が Hold や Retention Policy で保護されていて、削除や上書きができない場合に 403 を返す
+func (b *bucketEntry) checkRetention(o *objectEntry, now time.Time) error {
+	a := o.attrs
+	if a.TemporaryHold {
+		return errRetentionPolicyNotMet(fmt.Sprintf("Object '%s/%s' is under active Temporary hold and cannot be deleted, overwritten or archived until hold is removed.", a.Bucket, a.Name))
+	}
+	if a.EventBasedHold {
+		return errRetentionPolicyNotMet(fmt.Sprintf("Object '%s/%s' is under active Event-Based hold and cannot be deleted, overwritten or archived until hold is removed.", a.Bucket, a.Name))
+	}
+	if a.RetentionExpirationTime == "" {
+		return nil
+	}
+	expiration, err := time.Parse(time.RFC3339Nano, a.RetentionExpirationTime)
+	if err != nil {
+		return err
+	}
+	if now.Before(expiration) {
+		return errRetentionPolicyNotMet(fmt.Sprintf("Object '%s/%s' is subject to bucket's retention policy and cannot be deleted, overwritten or archived until %s", a.Bucket, a.Name, a.RetentionExpirationTime))
+	}
+	return nil
+}
+
+// retentionPeriodOf is Bucket の Retention Policy の期間を返す
+// Retention Policy が無い場合は 0
+func retentionPeriodOf(attrs *apigcs.Bucket) time.Duration {
+	if attrs.RetentionPolicy == nil {
+		return 0
+	}
+	return time.Duration(attrs.RetentionPolicy.RetentionPeriod) * time.Second
+}
+
+// applyRetention is Object の RetentionExpirationTime を Bucket の Retention Policy に合わせる
+// Event-Based hold が有効な間は期限が決まらず、hold を解除した時刻 since から期間が始まる
+func (b *bucketEntry) applyRetention(o *objectEntry, since time.Time) {
+	period := retentionPeriodOf(b.attrs)
+	if period == 0 || o.attrs.EventBasedHold {
+		o.attrs.RetentionExpirationTime = ""
+		return
+	}
+	o.attrs.RetentionExpirationTime = since.Add(period).UTC().Format(time.RFC3339Nano)
+}
+
+// releaseHold is Object の metadata を変更した後に、Event-Based hold が解除されていれば Retention の期間を始める
+func (b *bucketEntry) releaseHold(o *objectEntry, eventBasedHold bool, now time.Time) {
+	if eventBasedHold && !o.attrs.EventBasedHold {
+		b.applyRetention(o, now)
+	}
+}
+
+// checkRetentionPolicyUpdate is Lock された Retention Policy を削除したり、期間を短くしたりする変更を拒否する
+func checkRetentionPolicyUpdate(previous *apigcs.Bucket, updated *apigcs.Bucket) error {
+	p := previous.RetentionPolicy
+	if p == nil || !p.IsLocked {
+		return nil
+	}
+	if updated.RetentionPolicy == nil || updated.RetentionPolicy.RetentionPeriod < p.RetentionPeriod {
+		return errRetentionPolicyLocked(previous.Name)
+	}
+	return nil
+}
+
+// resetRetention is Bucket の Retention Policy が変わった時に、全ての Object の RetentionExpirationTime を作成時刻から計算し直す
+func (b *bucketEntry) resetRetention() {
+	for _, l := range b.generations() {
+		for _, o := range l {
+			created, err := time.Parse(time.RFC3339Nano, o.attrs.TimeCreated)
+			if err != nil {
+				continue
+			}
+			b.applyRetention(o, created)
+		}
+	}
+}
+
+// lockRetentionPolicy is Bucket の Retention Policy を Lock する
+// Lock した後は Retention Policy を削除したり、期間を短くしたりできない
+func (s *store) lockRetentionPolicy(bucket string, cond *conditions) (*apigcs.Bucket, error) {
+	if cond == nil || cond.ifMetagenerationMatch == nil {
+		return nil, errInvalid("Required parameter ifMetagenerationMatch is missing.")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return nil, errBucketNotFound()
+	}
+	if err := cond.checkMetageneration(b.attrs.Metageneration); err != nil {
+		return nil, err
+	}
+	if b.attrs.RetentionPolicy == nil {
+		return nil, errInvalid(fmt.Sprintf("Bucket '%s' does not have a Retention Policy.", bucket))
+	}
+	b.attrs.RetentionPolicy.IsLocked = true
+	b.touch(s.now())
+	return b.cloneAttrs(), nil
+}
+
+func (s *server) lockRetentionPolicy(w http.ResponseWriter, ar *apiRequest, cond *conditions) {
+	bucket, err := s.store.lockRetentionPolicy(ar.bucket, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bucket)
+}
@@ -0,0 +1,180 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func assertRetentionPolicyNotMet(t *testing.T, err error) {
+	t.Helper()
+
+	assertStatusCode(t, err, http.StatusForbidden)
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || len(gerr.Errors) == 0 {
+		t.Fatalf("want googleapi.Error with reason but got %v", err)
+	}
+	if e, g := "retentionPolicyNotMet", gerr.Errors[0].Reason; e != g {
+		t.Errorf("want reason %s but got %s", e, g)
+	}
+}
+
+func TestStatefulFaker_TemporaryHold(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	obj := stg.Bucket("sinmetal-ci-fake").Object("hold.txt")
+	w := obj.NewWriter(ctx)
+	w.TemporaryHold = true
+	if _, err := w.Write([]byte("hold")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Attrs().TemporaryHold {
+		t.Error("want TemporaryHold")
+	}
+
+	assertRetentionPolicyNotMet(t, obj.Delete(ctx))
+	w = obj.NewWriter(ctx)
+	if _, err := w.Write([]byte("overwrite")); err != nil {
+		t.Fatal(err)
+	}
+	assertRetentionPolicyNotMet(t, w.Close())
+
+	// metadata の変更は hold 中でもできる
+	if _, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{ContentType: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{TemporaryHold: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.TemporaryHold {
+		t.Error("want TemporaryHold to be released")
+	}
+	if err := obj.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatefulFaker_RetentionPolicy(t *testing.T) {
+	ctx := context.Background()
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake-retention"
+	bkt := stg.Bucket(bucket)
+	if err := bkt.Create(ctx, "sinmetal-ci", &storage.BucketAttrs{
+		RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	attrs := writeObject(t, stg, bucket, "retained.txt", "retained")
+	if e, g := attrs.Created.Add(time.Hour), attrs.RetentionExpirationTime; !e.Equal(g) {
+		t.Errorf("want RetentionExpirationTime %v but got %v", e, g)
+	}
+
+	obj := bkt.Object("retained.txt")
+	assertRetentionPolicyNotMet(t, obj.Delete(ctx))
+
+	if err := faker.AdvanceTime(2 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatefulFaker_EventBasedHold(t *testing.T) {
+	ctx := context.Background()
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake-retention"
+	bkt := stg.Bucket(bucket)
+	if err := bkt.Create(ctx, "sinmetal-ci", &storage.BucketAttrs{
+		RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Client は Create の時に DefaultEventBasedHold を送らないので Update で設定する
+	if _, err := bkt.Update(ctx, storage.BucketAttrsToUpdate{DefaultEventBasedHold: true}); err != nil {
+		t.Fatal(err)
+	}
+	attrs := writeObject(t, stg, bucket, "event.txt", "event")
+	if !attrs.EventBasedHold {
+		t.Error("want EventBasedHold from DefaultEventBasedHold")
+	}
+	if !attrs.RetentionExpirationTime.IsZero() {
+		t.Errorf("want no RetentionExpirationTime while held but got %v", attrs.RetentionExpirationTime)
+	}
+
+	obj := bkt.Object("event.txt")
+	if err := faker.AdvanceTime(2 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertRetentionPolicyNotMet(t, obj.Delete(ctx))
+
+	// hold を解除した時から Retention Policy の期間が始まる
+	attrs, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{EventBasedHold: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := attrs.Updated.Add(time.Hour), attrs.RetentionExpirationTime; !e.Equal(g) {
+		t.Errorf("want RetentionExpirationTime %v but got %v", e, g)
+	}
+	assertRetentionPolicyNotMet(t, obj.Delete(ctx))
+
+	if err := faker.AdvanceTime(2 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatefulFaker_LockRetentionPolicy(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake-retention"
+	bkt := stg.Bucket(bucket)
+	if err := bkt.Create(ctx, "sinmetal-ci", &storage.BucketAttrs{
+		RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := bkt.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertPreconditionFailed(t, bkt.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration + 1}).LockRetentionPolicy(ctx))
+	if err := bkt.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration}).LockRetentionPolicy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err = bkt.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attrs.RetentionPolicy.IsLocked {
+		t.Error("want locked RetentionPolicy")
+	}
+
+	_, err = bkt.Update(ctx, storage.BucketAttrsToUpdate{RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: time.Minute}})
+	assertStatusCode(t, err, http.StatusForbidden)
+	_, err = bkt.Update(ctx, storage.BucketAttrsToUpdate{RetentionPolicy: &storage.RetentionPolicy{}})
+	assertStatusCode(t, err, http.StatusForbidden)
+	attrs, err = bkt.Update(ctx, storage.BucketAttrsToUpdate{RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: 2 * time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 2*time.Hour, attrs.RetentionPolicy.RetentionPeriod; e != g {
+		t.Errorf("want RetentionPeriod %v but got %v", e, g)
+	}
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// rewriteToken is objects.rewrite を複数回に分けて行う時の途中経過
+// base64 にした JSON を rewriteToken として Client に返し、次の Request で受け取る
+type rewriteToken struct {
+	// Generation is 1回目の Request で読んだコピー元の Generation
+	// 途中でコピー元が上書きされても、同じ Generation をコピーし続ける
+	Generation int64 `json:"g"`
+
+	// Written is これまでにコピーした byte 数
+	Written int64 `json:"w"`
+}
+
+// rewriteObject is Object を別の Object にコピーする
+//
+// maxBytesRewrittenPerCall が指定されていて、Object の Size がそれより大きい場合は
+// 指定された byte 数ずつ進めて、途中の場合は done=false と rewriteToken を返す
+// Request の body に Object の metadata が含まれている場合は、コピー元の metadata の代わりにそれを使う
+func (s *server) rewriteObject(w http.ResponseWriter, r *http.Request, ar *apiRequest, cond *conditions) {
+	srcCond, err := parseSourceConditions(ar)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	token := &rewriteToken{}
+	if v := ar.query.Get("rewriteToken"); v != "" {
+		if token, err = decodeRewriteToken(v); err != nil {
+			writeError(w, ar, err)
+			return
+		}
+		srcCond = &conditions{generation: &token.Generation}
+	}
+	var maxBytes int64
+	if v := ar.query.Get("maxBytesRewrittenPerCall"); v != "" {
+		if maxBytes, err = strconv.ParseInt(v, 10, 64); err != nil || maxBytes < 0 {
+			writeError(w, ar, errInvalid(fmt.Sprintf("Invalid value for maxBytesRewrittenPerCall: %s", v)))
+			return
+		}
+	}
+	override, err := readRewriteMetadata(r)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+
+	src, err := s.store.getObject(ar.bucket, ar.object, srcCond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	if !src.blob.retain() {
+		// 取得した後に削除されて、中身が Release されている
+		writeError(w, ar, errObjectNotFound(ar.bucket, ar.object))
+		return
+	}
+	defer src.blob.drop()
+	size := src.blob.Size()
+	token.Generation = src.attrs.Generation
+	token.Written += maxBytes
+	if maxBytes > 0 && token.Written < size {
+		b, err := json.Marshal(token)
+		if err != nil {
+			writeError(w, ar, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &apigcs.RewriteResponse{
+			Kind:                "storage#rewriteResponse",
+			TotalBytesRewritten: token.Written,
+			ObjectSize:          size,
+			Done:                false,
+			RewriteToken:        base64.RawURLEncoding.EncodeToString(b),
+		})
+		return
+	}
+
+	attrs := src.attrs
+	if override != nil {
+		attrs = override
+	}
+	dest := *attrs
+	dest.Name = ar.destinationObject
+	if override == nil {
+		// ACL と Hold はコピーせずに、コピー先の Bucket の Default Object ACL と Default Event Based Hold になる
+		dest.Acl = nil
+		dest.TemporaryHold = false
+		dest.EventBasedHold = false
+	}
+	// Retention はコピー先の Bucket の Retention Policy で決まる
+	dest.RetentionExpirationTime = ""
+	if err := applyPredefinedACL(&dest, ar.query.Get("destinationPredefinedAcl")); err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	// 中身は変わらないので、コピー元の Blob をそのまま使う
+	hash := &objectHash{md5: src.attrs.Md5Hash, crc32c: src.attrs.Crc32c}
+	obj, err := s.store.copyObject(ar.destinationBucket, &dest, src.blob, hash, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &apigcs.RewriteResponse{
+		Kind:                "storage#rewriteResponse",
+		TotalBytesRewritten: size,
+		ObjectSize:          size,
+		Done:                true,
+		Resource:            applyProjection(obj, ar.query.Get("projection")),
+	})
+}
+
+// readRewriteMetadata is objects.rewrite の body からコピー先の metadata を読む
+// body が空か、Client が指定できる項目を何も含んでいない場合は nil を返す
+func readRewriteMetadata(r *http.Request) (*apigcs.Object, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, errInvalid(err.Error())
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var attrs apigcs.Object
+	if err := json.Unmarshal(b, &attrs); err != nil {
+		return nil, errInvalid(err.Error())
+	}
+	if attrs.ContentType == "" && attrs.ContentEncoding == "" && attrs.ContentDisposition == "" &&
+		attrs.ContentLanguage == "" && attrs.CacheControl == "" && attrs.CustomTime == "" &&
+		len(attrs.Metadata) == 0 && attrs.StorageClass == "" && len(attrs.Acl) == 0 {
+		return nil, nil
+	}
+	return &attrs, nil
+}
+
+func decodeRewriteToken(v string) (*rewriteToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errInvalid(fmt.Sprintf("Invalid rewrite token: %s", v))
+	}
+	var token rewriteToken
+	if err := json.Unmarshal(b, &token); err != nil {
+		return nil, errInvalid(fmt.Sprintf("Invalid rewrite token: %s", v))
+	}
+	return &token, nil
+}
@@ -0,0 +1,154 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+func TestStatefulFaker_Copy(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const src = "sinmetal-ci-fake"
+	const dst = "sinmetal-ci-fake-copy"
+	w := stg.Bucket(src).Object("source.txt").NewWriter(ctx)
+	w.ContentType = "text/plain"
+	w.Metadata = map[string]string{"owner": "sinmetal"}
+	if _, err := w.Write([]byte("hello copy")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stg.Bucket(dst).Create(ctx, "sinmetal-ci", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("cross bucket", func(t *testing.T) {
+		attrs, err := stg.Bucket(dst).Object("copied.txt").CopierFrom(stg.Bucket(src).Object("source.txt")).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := "text/plain", attrs.ContentType; e != g {
+			t.Errorf("want contentType %s but got %s", e, g)
+		}
+		if e, g := map[string]string{"owner": "sinmetal"}, attrs.Metadata; !cmp.Equal(e, g) {
+			t.Errorf("unexpected metadata %s", cmp.Diff(e, g))
+		}
+		if e, g := "hello copy", readObject(t, stg, dst, "copied.txt"); e != g {
+			t.Errorf("want body %q but got %q", e, g)
+		}
+	})
+
+	t.Run("override metadata", func(t *testing.T) {
+		copier := stg.Bucket(dst).Object("overridden.txt").CopierFrom(stg.Bucket(src).Object("source.txt"))
+		copier.ContentType = "text/csv"
+		copier.Metadata = map[string]string{"copied": "true"}
+		attrs, err := copier.Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := "text/csv", attrs.ContentType; e != g {
+			t.Errorf("want contentType %s but got %s", e, g)
+		}
+		if e, g := map[string]string{"copied": "true"}, attrs.Metadata; !cmp.Equal(e, g) {
+			t.Errorf("unexpected metadata %s", cmp.Diff(e, g))
+		}
+	})
+
+	t.Run("holds are not copied", func(t *testing.T) {
+		held := stg.Bucket(src).Object("held.txt")
+		w := held.NewWriter(ctx)
+		w.TemporaryHold = true
+		w.EventBasedHold = true
+		if _, err := w.Write([]byte("held")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if _, err := held.Update(ctx, storage.ObjectAttrsToUpdate{TemporaryHold: false, EventBasedHold: false}); err != nil {
+				t.Error(err)
+			}
+		})
+
+		attrs, err := stg.Bucket(dst).Object("held-copy.txt").CopierFrom(held).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.TemporaryHold || attrs.EventBasedHold {
+			t.Errorf("want no holds but got TemporaryHold=%v EventBasedHold=%v", attrs.TemporaryHold, attrs.EventBasedHold)
+		}
+		if err := stg.Bucket(dst).Object("held-copy.txt").Delete(ctx); err != nil {
+			t.Errorf("want copied object is deletable but got %v", err)
+		}
+	})
+
+	t.Run("destination bucket not found", func(t *testing.T) {
+		_, err := stg.Bucket("sinmetal-ci-not-found").Object("copied.txt").CopierFrom(stg.Bucket(src).Object("source.txt")).Run(ctx)
+		assertStatusCode(t, err, http.StatusNotFound)
+		if _, err := stg.Bucket("sinmetal-ci-not-found").Attrs(ctx); !errors.Is(err, storage.ErrBucketNotExist) {
+			t.Errorf("want destination bucket is not created but got %v", err)
+		}
+	})
+}
+
+// TestStatefulFaker_RewriteToken is maxBytesRewrittenPerCall を指定して複数回に分けて rewrite する
+// Client Library からは maxBytesRewrittenPerCall を指定できないので、直接 Request する
+func TestStatefulFaker_RewriteToken(t *testing.T) {
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	body := strings.Repeat("a", 25)
+	writeObject(t, stg, bucket, "large.bin", body)
+
+	var token string
+	var calls int
+	for {
+		u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s/rewriteTo/b/%s/o/%s?maxBytesRewrittenPerCall=10", bucket, "large.bin", bucket, "rewritten.bin")
+		if token != "" {
+			u += "&rewriteToken=" + url.QueryEscape(token)
+		}
+		res, err := faker.Client.Post(u, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rr apigcs.RewriteResponse
+		err = json.NewDecoder(res.Body).Decode(&rr)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := http.StatusOK, res.StatusCode; e != g {
+			t.Fatalf("want status %d but got %d", e, g)
+		}
+		calls++
+		if rr.Done {
+			if e, g := int64(25), rr.TotalBytesRewritten; e != g {
+				t.Errorf("want totalBytesRewritten %d but got %d", e, g)
+			}
+			break
+		}
+		if e, g := int64(calls*10), rr.TotalBytesRewritten; e != g {
+			t.Errorf("want totalBytesRewritten %d but got %d", e, g)
+		}
+		token = rr.RewriteToken
+	}
+	if e, g := 3, calls; e != g {
+		t.Errorf("want %d calls but got %d", e, g)
+	}
+	if e, g := body, readObject(t, stg, bucket, "rewritten.bin"); e != g {
+		t.Errorf("want body %q but got %q", e, g)
+	}
+}
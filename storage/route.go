@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// RequestMatcher is AddResponseWithMatcher で登録した Response を返す Request かどうかを判定する
+// Faker の Lock の外で呼ぶので、RequestMatcher の中で Response を登録しても deadlock しない
+type RequestMatcher func(req *http.Request) bool
+
+// routeKey is 登録した Response と Request を比べるための GCS の操作の内容
+//
+// URL の文字列ではなく、Request を解釈した操作と対象で比べるので、
+// Client Library が Query Parameter を追加したり順番を変えたりしても一致する
+type routeKey struct {
+	operation operation
+	bucket    string
+	object    string
+
+	acl    aclResource
+	entity string
+
+	destinationBucket string
+	destinationObject string
+
+	// generation is 空の場合は全ての Generation に一致する
+	generation string
+
+	// resumable is uploadType=resumable の Upload Session の開始の場合 true
+	// Session の開始には Object の書き込みの Response ではなく、Session の URL を返す
+	resumable bool
+
+	// method, path, query is GCS の操作として解釈できない Request の場合だけ使う
+	// query は並べ替えて encode したもの
+	method string
+	path   string
+	query  string
+}
+
+// newRouteKey is Request を解釈した ar から routeKey を作る
+func newRouteKey(req *http.Request, ar *apiRequest) routeKey {
+	if ar.operation == operationUnknown {
+		return routeKey{
+			method: strings.ToUpper(req.Method),
+			path:   req.URL.EscapedPath(),
+			query:  req.URL.Query().Encode(),
+		}
+	}
+	return routeKey{
+		operation:         ar.operation,
+		bucket:            ar.bucket,
+		object:            ar.object,
+		acl:               ar.acl,
+		entity:            ar.entity,
+		destinationBucket: ar.destinationBucket,
+		destinationObject: ar.destinationObject,
+		generation:        ar.query.Get("generation"),
+		resumable:         ar.operation == operationInsertObject && ar.isResumableUpload(),
+	}
+}
+
+// routeKeyOf is URL と Method から routeKey を作る
+// 一致しなかった時の報告に使うので、URL の Query Parameter も返す
+func routeKeyOf(rawURL string, method string) (routeKey, url.Values, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return routeKey{}, nil, fmt.Errorf("invalid url %q : %w", rawURL, err)
+	}
+	return newRouteKey(req, parseRequest(req)), req.URL.Query(), nil
+}
+
+// matches is 登録した key が Request の key に一致するかを返す
+// 登録した key で generation を指定していない場合は、Request の generation は見ない
+func (k routeKey) matches(req routeKey) bool {
+	if k.generation == "" {
+		req.generation = ""
+	}
+	return k == req
+}
+
+// String is 一致しなかった時のエラーメッセージに使う
+func (k routeKey) String() string {
+	if k.operation == operationUnknown {
+		if k.query == "" {
+			return fmt.Sprintf("%s %s", k.method, k.path)
+		}
+		return fmt.Sprintf("%s %s?%s", k.method, k.path, k.query)
+	}
+	s := fmt.Sprintf("%s bucket=%q object=%q", k.operation, k.bucket, k.object)
+	if k.entity != "" {
+		s += fmt.Sprintf(" entity=%q", k.entity)
+	}
+	if k.destinationBucket != "" {
+		s += fmt.Sprintf(" destination=%q", k.destinationBucket+"/"+k.destinationObject)
+	}
+	if k.generation != "" {
+		s += fmt.Sprintf(" generation=%s", k.generation)
+	}
+	return s
+}
+
+// registration is 登録された1つの Response
+// matcher がある場合は key ではなく matcher で Request と比べる
+type registration struct {
+	key     routeKey
+	matcher RequestMatcher
+	builder ResponseBuilder
+
+	// query is Add で登録した URL の Query Parameter
+	// 一致しなかった時の報告だけに使う
+	query url.Values
+
+	// always is true の場合は1回返しても登録を取り除かず、一致する全ての Request に返す
+	always bool
+}
+
+// priority is 同じ Request に一致する登録が複数ある時に、どれを返すかを決める
+// generation を指定した登録を優先し、次に1回だけ返す登録を always の登録よりも優先する
+func (r *registration) priority() int {
+	p := 0
+	if r.key.generation != "" {
+		p += 2
+	}
+	if !r.always {
+		p++
+	}
+	return p
+}
+
+// fakeResponses is 登録された Response を登録順に保持する
+// 同じ Request に一致する Response が複数ある場合は、登録順に1回ずつ返していく
+// 並行に Request されても、1つの登録を2回返すことは無い
+type fakeResponses struct {
+	mu            sync.Mutex
+	registrations []*registration
+}
+
+// responseBuilderOf is http.Response を何度でも返せるように StaticResponse にする
+func responseBuilderOf(response *http.Response) (ResponseBuilder, error) {
+	return NewStaticResponse(response)
+}
+
+// Add is url と method の Request に対する Response を登録する
+func (f *fakeResponses) Add(url string, method string, builder ResponseBuilder, always bool) error {
+	key, query, err := routeKeyOf(url, method)
+	if err != nil {
+		return err
+	}
+	f.add(&registration{key: key, builder: builder, query: query, always: always})
+	return nil
+}
+
+// AddKey is key に一致する Request に対する Response を登録する
+func (f *fakeResponses) AddKey(key routeKey, builder ResponseBuilder, always bool) {
+	f.add(&registration{key: key, builder: builder, always: always})
+}
+
+// AddMatcher is matcher に一致する Request に対する Response を登録する
+func (f *fakeResponses) AddMatcher(matcher RequestMatcher, builder ResponseBuilder, always bool) {
+	f.add(&registration{matcher: matcher, builder: builder, always: always})
+}
+
+func (f *fakeResponses) add(r *registration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.registrations = append(f.registrations, r)
+}
+
+// Get is Request に一致する Response を作る
+// matcher で登録した Response を key で登録した Response よりも優先する
+func (f *fakeResponses) Get(req *http.Request, ar *apiRequest) (*http.Response, error) {
+	found := f.find(func(r *registration) bool {
+		return r.matcher != nil && r.matcher(req)
+	})
+	if found == nil {
+		key := newRouteKey(req, ar)
+		found = f.find(func(r *registration) bool {
+			return r.matcher == nil && r.key.matches(key)
+		})
+		if found == nil {
+			return nil, fmt.Errorf("response is not registered. %s", key)
+		}
+	}
+	return found.builder.Build(req)
+}
+
+// GetKey is key に一致する Response を作る
+// matcher で登録した Response は対象にしない
+func (f *fakeResponses) GetKey(key routeKey, req *http.Request) (*http.Response, error) {
+	found := f.find(func(r *registration) bool {
+		return r.matcher == nil && r.key.matches(key)
+	})
+	if found == nil {
+		return nil, fmt.Errorf("response is not registered. %s", key)
+	}
+	return found.builder.Build(req)
+}
+
+// find is match する登録の中で priority が一番高く、先に登録したものを返す
+// 1回だけ返す登録は取り除く
+// match と Response の作成は Lock の外で行うので、RequestMatcher や ResponseBuilder の中で Faker を使っても deadlock しない
+func (f *fakeResponses) find(match func(r *registration) bool) *registration {
+	for {
+		f.mu.Lock()
+		candidates := append([]*registration(nil), f.registrations...)
+		f.mu.Unlock()
+
+		var found *registration
+		for _, r := range candidates {
+			if match(r) && (found == nil || r.priority() > found.priority()) {
+				found = r
+			}
+		}
+		if found == nil || found.always {
+			return found
+		}
+		if f.consume(found) {
+			return found
+		}
+		// match している間に別の Request が同じ登録を使ったので、もう一度探す
+	}
+}
+
+// consume is 1回だけ返す登録 r を取り除く
+// 既に取り除かれていた場合は false を返す
+func (f *fakeResponses) consume(r *registration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, v := range f.registrations {
+		if v == r {
+			f.registrations = append(f.registrations[:i], f.registrations[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// unconsumed is まだ返していない1回だけ返す登録を登録順に返す
+// always の登録は何回でも返すので含めない
+func (f *fakeResponses) unconsumed() []*registration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var l []*registration
+	for _, r := range f.registrations {
+		if !r.always {
+			l = append(l, r)
+		}
+	}
+	return l
+}
@@ -0,0 +1,135 @@
+package storage_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func newJSONResponse(body string) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"application/json; charset=UTF-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func TestAddResponse_IgnoresQueryOrderAndIrrelevantParameters(t *testing.T) {
+	ctx := context.Background()
+	faker := storagefaker.NewFaker(t)
+	stg, err := storage.NewClient(ctx, option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client は alt=json&prettyPrint=false&projection=full を付けるが、登録した URL には無くても一致する
+	err = faker.AddResponse("https://storage.googleapis.com/storage/v1/b/sinmetal-ci-fake/o/dir%2Fhello.txt?prettyPrint=false", http.MethodGet,
+		newJSONResponse(`{"bucket":"sinmetal-ci-fake","name":"dir/hello.txt","size":"5"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := stg.Bucket("sinmetal-ci-fake").Object("dir/hello.txt").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int64(5), attrs.Size; e != g {
+		t.Errorf("want size %d but got %d", e, g)
+	}
+}
+
+func TestAddResponse_UnknownOperation(t *testing.T) {
+	faker := storagefaker.NewFaker(t)
+	if err := faker.AddResponse("https://example.com/custom?b=2&a=1", http.MethodGet, newTextResponse("custom")); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "custom", getBody(t, faker.Client, "https://example.com/custom?a=1&b=2"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+}
+
+func TestAddResponseWithMatcher(t *testing.T) {
+	faker := storagefaker.NewFaker(t)
+	if err := faker.AddGetObjectResponse("sinmetal-ci-fake", "hello.txt", newTextResponse("registered by object")); err != nil {
+		t.Fatal(err)
+	}
+	err := faker.AddResponseWithMatcher(func(req *http.Request) bool {
+		return req.Header.Get("X-Test-Scenario") == "matcher"
+	}, newTextResponse("registered by matcher"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/sinmetal-ci-fake/hello.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Test-Scenario", "matcher")
+	res, err := faker.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "registered by matcher", string(b); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	if e, g := "registered by object", getBody(t, faker.Client, "https://storage.googleapis.com/sinmetal-ci-fake/hello.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+}
+
+func TestAddResponseWithMatcher_CallsBackIntoFaker(t *testing.T) {
+	faker := storagefaker.NewFaker(t)
+	// matcher の中で次の Request の Response を登録する
+	err := faker.AddResponseWithMatcher(func(req *http.Request) bool {
+		if req.Header.Get("X-Test-Scenario") != "matcher" {
+			return false
+		}
+		if err := faker.AddGetObjectResponse("sinmetal-ci-fake", "hello.txt", newTextResponse("registered in matcher")); err != nil {
+			t.Error(err)
+		}
+		return true
+	}, newTextResponse("registered by matcher"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/sinmetal-ci-fake/hello.txt", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.Header.Set("X-Test-Scenario", "matcher")
+		res, err := faker.Client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = res.Body.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock in RequestMatcher")
+	}
+	if e, g := "registered in matcher", getBody(t, faker.Client, "https://storage.googleapis.com/sinmetal-ci-fake/hello.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+}
@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// MetadataSidecarSuffix is Seed と ExportDir で Object の metadata を置く sidecar file の名前の suffix
+//
+// {bucket}/{object} の metadata は {bucket}/{object}.gcs-metadata.json に、JSON API の Object resource と同じ形式で書く
+// contentType, cacheControl, metadata など Client が Upload 時に指定できる項目だけを使う
+// sidecar が無い場合、contentType は拡張子から決める
+const MetadataSidecarSuffix = ".gcs-metadata.json"
+
+// Seed is fsys の中の file を stateful mode の store に Object として書き込む
+//
+// fsys の直下の directory が Bucket になり、その下の file の path が Object 名になる
+// testdata/gcs/{bucket}/{object} を Seed(os.DirFS("testdata/gcs")) で読み込むと、{bucket} に {object} が作成される
+// file が無い directory は空の Bucket になる
+// file の中身は memory に読み込まずに、1つずつ store の Backend に書き込む
+func (faker *Faker) Seed(fsys fs.FS) error {
+	st, err := faker.statefulStore("Seed")
+	if err != nil {
+		return err
+	}
+	var buckets []string
+	objects := make(map[string]seedObject)
+	sidecars := make(map[string][]byte)
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if !strings.Contains(p, "/") {
+				buckets = append(buckets, p)
+			}
+			return nil
+		}
+		if strings.HasSuffix(p, MetadataSidecarSuffix) {
+			b, err := fs.ReadFile(fsys, p)
+			if err != nil {
+				return err
+			}
+			sidecars[p] = b
+			return nil
+		}
+		objects[p] = func() (Blob, *objectHash, error) {
+			f, err := fsys.Open(p)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer f.Close()
+			return writeBlob(st.backend, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed read seed : %w", err)
+	}
+	return st.seed(buckets, objects, sidecars)
+}
+
+// SeedDir is dir の中の file を Seed と同じように stateful mode の store に書き込む
+func (faker *Faker) SeedDir(dir string) error {
+	return faker.Seed(os.DirFS(dir))
+}
+
+// SeedTar is tar の中の file を Seed と同じように stateful mode の store に書き込む
+// tar の中の path は {bucket}/{object} になっている必要がある
+// tar は先頭から順に読むしかないので、file の中身は読んだ順に store の Backend に書き込み、最後に path の順で Object にする
+func (faker *Faker) SeedTar(r io.Reader) error {
+	st, err := faker.statefulStore("SeedTar")
+	if err != nil {
+		return err
+	}
+	var buckets []string
+	objects := make(map[string]seedObject)
+	sidecars := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed read tar : %w", err)
+		}
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if !strings.Contains(name, "/") {
+				buckets = append(buckets, name)
+			}
+		case tar.TypeReg:
+			if strings.HasSuffix(name, MetadataSidecarSuffix) {
+				b, err := io.ReadAll(tr)
+				if err != nil {
+					return fmt.Errorf("failed read %s in tar : %w", hdr.Name, err)
+				}
+				sidecars[name] = b
+				continue
+			}
+			blob, hash, err := writeBlob(st.backend, tr)
+			if err != nil {
+				return fmt.Errorf("failed read %s in tar : %w", hdr.Name, err)
+			}
+			objects[name] = func() (Blob, *objectHash, error) {
+				return blob, hash, nil
+			}
+		}
+	}
+	return st.seed(buckets, objects, sidecars)
+}
+
+// ExportDir is stateful mode の store の最新の Generation の Object を dir に書き出す
+//
+// Seed と同じ {bucket}/{object} の構成で書き出すので、golden file と比べたり、そのまま Seed に使ったりできる
+// 拡張子から決まる contentType 以外の metadata がある Object は、sidecar file にも書き出す
+func (faker *Faker) ExportDir(dir string) error {
+	st, err := faker.statefulStore("ExportDir")
+	if err != nil {
+		return err
+	}
+	for _, bucket := range st.listBuckets("", "") {
+		if err := os.MkdirAll(filepath.Join(dir, bucket.Name), 0755); err != nil {
+			return err
+		}
+		objects, err := st.listObjects(bucket.Name, false)
+		if err != nil {
+			return err
+		}
+		for _, attrs := range objects {
+			if !fs.ValidPath(attrs.Name) {
+				return fmt.Errorf("object %q in %s can not be exported as file", attrs.Name, bucket.Name)
+			}
+			o, err := st.getObject(bucket.Name, attrs.Name, nil)
+			if err != nil {
+				return err
+			}
+			name := filepath.Join(dir, bucket.Name, filepath.FromSlash(attrs.Name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				return err
+			}
+			if !o.blob.retain() {
+				// 取得した後に上書きや削除された
+				continue
+			}
+			err = exportBlob(name, o.blob)
+			o.blob.drop()
+			if err != nil {
+				return err
+			}
+			sidecar, err := sidecarOf(o.attrs)
+			if err != nil {
+				return err
+			}
+			if sidecar != nil {
+				if err := os.WriteFile(name+MetadataSidecarSuffix, sidecar, 0644); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// exportBlob is Object の中身を memory に読み込まずに name の file に書き出す
+func exportBlob(name string, blob Blob) error {
+	r, err := blob.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// statefulStore is stateful mode の store を返す
+// stateful mode ではない時は name を含めた error を返す
+func (faker *Faker) statefulStore(name string) (*store, error) {
+	if faker.transport.server == nil {
+		return nil, fmt.Errorf("%s is only available in stateful mode", name)
+	}
+	return faker.transport.server.store, nil
+}
+
+// seedObject is Seed する Object の中身を Backend に書き込んで、Blob と objectHash を返す
+type seedObject func() (Blob, *objectHash, error)
+
+// seed is buckets の Bucket を作成して、{bucket}/{object} の path の objects を Object として書き込む
+// sidecars は path に MetadataSidecarSuffix を付けた path の metadata
+// Object は path の順に書き込む
+func (s *store) seed(buckets []string, objects map[string]seedObject, sidecars map[string][]byte) error {
+	for p := range sidecars {
+		if _, ok := objects[strings.TrimSuffix(p, MetadataSidecarSuffix)]; !ok {
+			return fmt.Errorf("object for metadata sidecar %s is not found", p)
+		}
+	}
+
+	s.mu.Lock()
+	for _, name := range buckets {
+		s.bucket(name, s.now())
+	}
+	s.mu.Unlock()
+
+	paths := make([]string, 0, len(objects))
+	for p := range objects {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		i := strings.Index(p, "/")
+		if i < 0 {
+			return fmt.Errorf("file %s is not in bucket directory", p)
+		}
+		bucket, object := p[:i], p[i+1:]
+		attrs := &apigcs.Object{}
+		if sidecar, ok := sidecars[p+MetadataSidecarSuffix]; ok {
+			if err := json.Unmarshal(sidecar, attrs); err != nil {
+				return fmt.Errorf("invalid metadata sidecar %s : %w", p+MetadataSidecarSuffix, err)
+			}
+		}
+		attrs.Name = object
+		if attrs.ContentType == "" {
+			attrs.ContentType = mime.TypeByExtension(path.Ext(object))
+		}
+		blob, hash, err := objects[p]()
+		if err != nil {
+			return fmt.Errorf("failed read %s : %w", p, err)
+		}
+		sb := newStoredBlob(blob)
+		_, err = s.putBlob(bucket, attrs, sb, hash, nil)
+		sb.drop()
+		if err != nil {
+			return fmt.Errorf("failed seed %s : %w", p, err)
+		}
+	}
+	return nil
+}
+
+// sidecarOf is Object の metadata の sidecar file の中身を返す
+// contentType が拡張子から決まるものと同じで、それ以外の metadata も無い場合は nil を返す
+func sidecarOf(attrs *apigcs.Object) ([]byte, error) {
+	sidecar := &apigcs.Object{
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentLanguage:    attrs.ContentLanguage,
+		CacheControl:       attrs.CacheControl,
+		CustomTime:         attrs.CustomTime,
+		Metadata:           attrs.Metadata,
+	}
+	if attrs.StorageClass != "STANDARD" {
+		sidecar.StorageClass = attrs.StorageClass
+	}
+	if sidecar.ContentType == mime.TypeByExtension(path.Ext(attrs.Name)) {
+		sidecar.ContentType = ""
+	}
+	b, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if string(b) == "{}" {
+		return nil, nil
+	}
+	return append(b, '\n'), nil
+}
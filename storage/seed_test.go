@@ -0,0 +1,199 @@
+package storage_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/iterator"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+// readTree is dir の中の全ての file を path と中身の map にする
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	tree := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		tree[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestStatefulFaker_SeedDirAndExportDir(t *testing.T) {
+	ctx := context.Background()
+	const bucket = "sinmetal-ci-fake"
+
+	faker, stg := newStatefulClient(t)
+	if err := faker.SeedDir("testdata/gcs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, g := "Hello Seed\n", readObject(t, stg, bucket, "dir/hello.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	attrs, err := stg.Bucket(bucket).Object("dir/hello.txt").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "text/plain", attrs.ContentType; e != g {
+		t.Errorf("want ContentType %q but got %q", e, g)
+	}
+	if e, g := "no-cache", attrs.CacheControl; e != g {
+		t.Errorf("want CacheControl %q but got %q", e, g)
+	}
+	if e, g := map[string]string{"owner": "sinmetal"}, attrs.Metadata; !cmp.Equal(e, g) {
+		t.Errorf("unexpected Metadata %s", cmp.Diff(e, g))
+	}
+	if _, err := stg.Bucket("sinmetal-ci-fake-2").Attrs(ctx); err != nil {
+		t.Errorf("seeded bucket is not found : %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := faker.ExportDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := readTree(t, "testdata/gcs"), readTree(t, dir); !cmp.Equal(e, g) {
+		t.Errorf("exported tree is different from seed %s", cmp.Diff(e, g))
+	}
+}
+
+func TestStatefulFaker_Seed(t *testing.T) {
+	const bucket = "sinmetal-ci-fake"
+
+	faker, stg := newStatefulClient(t)
+	err := faker.Seed(fstest.MapFS{
+		bucket + "/a.txt":       {Data: []byte("a")},
+		bucket + "/dir/b.txt":   {Data: []byte("b")},
+		"empty-bucket":          {Mode: fs.ModeDir},
+		bucket + "/dir/c.bin":   {Data: []byte{0x01, 0x02}},
+		bucket + "/dir/d.image": {Data: []byte("d")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := []string{"a.txt", "dir/b.txt", "dir/c.bin", "dir/d.image"}, listObjectNames(t, stg, bucket, nil); !cmp.Equal(e, g) {
+		t.Errorf("unexpected objects %s", cmp.Diff(e, g))
+	}
+	if e, g := []string(nil), listObjectNames(t, stg, "empty-bucket", nil); !cmp.Equal(e, g) {
+		t.Errorf("unexpected objects %s", cmp.Diff(e, g))
+	}
+}
+
+func TestStatefulFaker_SeedAndListBuckets(t *testing.T) {
+	ctx := context.Background()
+
+	faker, stg := newStatefulClient(t)
+	if err := faker.SeedDir("testdata/gcs"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	it := stg.Buckets(ctx, "sinmetal-ci")
+	for {
+		b, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b.Name)
+	}
+	if e := []string{"sinmetal-ci-fake", "sinmetal-ci-fake-2"}; !cmp.Equal(e, got) {
+		t.Errorf("unexpected buckets %s", cmp.Diff(e, got))
+	}
+}
+
+func TestStatefulFaker_SeedTar(t *testing.T) {
+	const bucket = "sinmetal-ci-fake"
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		body string
+	}{
+		{bucket + "/hello.txt", "Hello Tar"},
+		{bucket + "/hello.txt" + storagefaker.MetadataSidecarSuffix, `{"metadata":{"source":"tar"}}`},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	faker, stg := newStatefulClient(t)
+	if err := faker.SeedTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "Hello Tar", readObject(t, stg, bucket, "hello.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	attrs, err := stg.Bucket(bucket).Object("hello.txt").Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "tar", attrs.Metadata["source"]; e != g {
+		t.Errorf("want metadata %q but got %q", e, g)
+	}
+}
+
+func TestStatefulFaker_SeedErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{"file outside bucket", fstest.MapFS{"hello.txt": {Data: []byte("hello")}}},
+		{"sidecar without object", fstest.MapFS{"sinmetal-ci-fake/hello.txt" + storagefaker.MetadataSidecarSuffix: {Data: []byte("{}")}}},
+		{"invalid sidecar", fstest.MapFS{
+			"sinmetal-ci-fake/hello.txt":                                      {Data: []byte("hello")},
+			"sinmetal-ci-fake/hello.txt" + storagefaker.MetadataSidecarSuffix: {Data: []byte("{")},
+		}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			faker := storagefaker.NewStatefulFaker(t)
+			if err := faker.Seed(tt.fsys); err == nil {
+				t.Error("want error but got nil")
+			}
+		})
+	}
+}
+
+func TestFaker_SeedRequiresStatefulMode(t *testing.T) {
+	faker := storagefaker.NewFaker(t)
+	if err := faker.Seed(fstest.MapFS{}); err == nil {
+		t.Error("want error but got nil")
+	}
+	if err := faker.ExportDir(t.TempDir()); err == nil {
+		t.Error("want error but got nil")
+	}
+}
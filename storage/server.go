@@ -0,0 +1,546 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+var _ http.Handler = &server{}
+
+// server is store の内容を GCS の JSON API, XML API として返す http.Handler
+type server struct {
+	store *store
+}
+
+func newServer(s *store) *server {
+	return &server{
+		store: s,
+	}
+}
+
+// roundTrip is http.RoundTripper として Request を処理する
+// Response の body は memory に溜めずに、ServeHTTP が書き込んだものを io.Pipe で Client に流す
+func (s *server) roundTrip(req *http.Request) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{
+		header: http.Header{},
+		pw:     pw,
+		ready:  make(chan *http.Response, 1),
+	}
+	go func() {
+		if req.Body != nil {
+			defer req.Body.Close()
+		}
+		s.ServeHTTP(w, req)
+		w.WriteHeader(http.StatusOK)
+		_ = pw.Close()
+	}()
+	res := <-w.ready
+	res.Body = pr
+	res.Request = req
+	return res, nil
+}
+
+// pipeResponseWriter is ServeHTTP が書き込んだ Response を io.Pipe で流す http.ResponseWriter
+// WriteHeader の時点の Header で http.Response を作成して ready に送る
+type pipeResponseWriter struct {
+	header      http.Header
+	pw          *io.PipeWriter
+	ready       chan *http.Response
+	wroteHeader bool
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	contentLength := int64(-1)
+	if v := w.header.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			contentLength = n
+		}
+	}
+	w.ready <- &http.Response{
+		Status:        fmt.Sprintf("%03d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header.Clone(),
+		ContentLength: contentLength,
+	}
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(p)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ar := parseRequest(r)
+	cond, err := parseConditions(ar)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	if ar.acl != "" {
+		s.accessControl(w, r, ar, cond)
+		return
+	}
+	switch ar.operation {
+	case operationInsertObject:
+		s.insertObject(w, r, ar, cond)
+	case operationGetObject:
+		s.getObject(w, ar, cond)
+	case operationDownloadObject:
+		s.downloadObject(w, r, ar, cond)
+	case operationPatchObject:
+		s.patchObject(w, r, ar, cond)
+	case operationUpdateObject:
+		s.updateObject(w, r, ar, cond)
+	case operationDeleteObject:
+		s.deleteObject(w, ar, cond)
+	case operationListObjects:
+		s.listObjects(w, ar)
+	case operationComposeObject:
+		s.composeObject(w, r, ar, cond)
+	case operationRewriteObject:
+		s.rewriteObject(w, r, ar, cond)
+	case operationInsertBucket:
+		s.insertBucket(w, r, ar)
+	case operationGetBucket:
+		s.getBucket(w, ar)
+	case operationPatchBucket:
+		s.patchBucket(w, r, ar, cond)
+	case operationDeleteBucket:
+		s.deleteBucket(w, ar, cond)
+	case operationListBuckets:
+		s.listBuckets(w, ar)
+	case operationLockRetentionPolicy:
+		s.lockRetentionPolicy(w, ar, cond)
+	default:
+		writeError(w, ar, &storeError{
+			code:    http.StatusNotImplemented,
+			reason:  "notImplemented",
+			message: fmt.Sprintf("%s %s is not supported by gcpfaker", r.Method, r.URL.String()),
+		})
+	}
+}
+
+// insertObject is uploadType=multipart, uploadType=media の Upload を処理する
+func (s *server) insertObject(w http.ResponseWriter, r *http.Request, ar *apiRequest, cond *conditions) {
+	attrs, content, err := readUpload(r, ar)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	if err := applyPredefinedACL(attrs, ar.query.Get("predefinedAcl")); err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	obj, err := s.store.putObject(ar.bucket, attrs, content, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	if ar.xml {
+		setUploadHeader(w.Header(), obj)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+// readUpload is uploadType=multipart, uploadType=media の body を Object の metadata と中身に分ける
+// 中身は memory に読み込まずに、r.Body から読む io.Reader として返す
+func readUpload(r *http.Request, ar *apiRequest) (*apigcs.Object, io.Reader, error) {
+	if ar.xml {
+		return readXMLUpload(r, ar)
+	}
+	var attrs *apigcs.Object
+	var content io.Reader
+	switch ar.query.Get("uploadType") {
+	case "multipart":
+		var err error
+		attrs, content, err = readMultipartUpload(r)
+		if err != nil {
+			return nil, nil, errInvalid(err.Error())
+		}
+	case "media":
+		attrs = &apigcs.Object{ContentType: r.Header.Get("Content-Type")}
+		content = r.Body
+	default:
+		return nil, nil, errInvalid(fmt.Sprintf("uploadType %q is not supported", ar.query.Get("uploadType")))
+	}
+	if name := ar.query.Get("name"); name != "" {
+		attrs.Name = name
+	}
+	return attrs, content, nil
+}
+
+// completeUpload is Resumable Upload で全ての chunk が揃った Object を store に書き込む
+// Precondition は Session を開始した Request で指定されたものを使う
+// chunk は Session で backend に書き込み済みなので、blob をそのまま Object の中身にする
+func (s *server) completeUpload(ar *apiRequest, attrs *apigcs.Object, blob *storedBlob, hash *objectHash) (*http.Response, error) {
+	cond, err := parseConditions(ar)
+	if err != nil {
+		return newErrorResponse(ar, err, nil), nil
+	}
+	if err := applyPredefinedACL(attrs, ar.query.Get("predefinedAcl")); err != nil {
+		return newErrorResponse(ar, err, nil), nil
+	}
+	obj, err := s.store.putBlob(ar.bucket, attrs, blob, hash, cond)
+	if err != nil {
+		return newErrorResponse(ar, err, nil), nil
+	}
+	rec := httptest.NewRecorder()
+	writeJSON(rec, http.StatusOK, obj)
+	return rec.Result(), nil
+}
+
+func (s *server) getObject(w http.ResponseWriter, ar *apiRequest, cond *conditions) {
+	obj, err := s.store.getObject(ar.bucket, ar.object, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, applyProjection(obj.attrs, ar.query.Get("projection")))
+}
+
+// downloadObject is Object の中身を返す
+// XML API と JSON API の alt=media のどちらも同じ Header を返す
+// Range Header が指定されている場合は、指定された範囲だけを 206 で返す
+func (s *server) downloadObject(w http.ResponseWriter, r *http.Request, ar *apiRequest, cond *conditions) {
+	obj, err := s.store.getObject(ar.bucket, ar.object, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	if !obj.blob.retain() {
+		// 取得した後に上書きや削除されて、中身が Release されている
+		writeError(w, ar, errObjectNotFound(ar.bucket, ar.object))
+		return
+	}
+	defer obj.blob.drop()
+	size := obj.blob.Size()
+	br, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil {
+		writeRangeNotSatisfiable(w, ar, size)
+		return
+	}
+	content, err := obj.blob.Open()
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	defer content.Close()
+	setObjectHeader(w.Header(), obj.attrs)
+	w.Header().Set("Accept-Ranges", "bytes")
+	length := size
+	code := http.StatusOK
+	if br != nil {
+		if _, err := content.Seek(br.first, io.SeekStart); err != nil {
+			writeError(w, ar, err)
+			return
+		}
+		length = br.length()
+		code = http.StatusPartialContent
+		w.Header().Set("Content-Range", br.contentRange(size))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(code)
+	if ar.method == http.MethodHead {
+		return
+	}
+	_, _ = io.CopyN(w, content, length)
+}
+
+func (s *server) patchObject(w http.ResponseWriter, r *http.Request, ar *apiRequest, cond *conditions) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, ar, errInvalid(err.Error()))
+		return
+	}
+	if v := ar.query.Get("predefinedAcl"); v != "" {
+		// predefinedAcl は body の acl を置き換えたものとして扱う
+		if b, err = patchWithPredefinedACL(b, v); err != nil {
+			writeError(w, ar, err)
+			return
+		}
+	}
+	obj, err := s.store.patchObject(ar.bucket, ar.object, b, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *server) updateObject(w http.ResponseWriter, r *http.Request, ar *apiRequest, cond *conditions) {
+	var attrs apigcs.Object
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+		writeError(w, ar, errInvalid(err.Error()))
+		return
+	}
+	obj, err := s.store.updateObject(ar.bucket, ar.object, &attrs, cond)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *server) deleteObject(w http.ResponseWriter, ar *apiRequest, cond *conditions) {
+	if err := s.store.deleteObject(ar.bucket, ar.object, cond); err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listObjects is prefix, delimiter, offset, matchGlob で絞り込んだ Object を page に分けて返す
+// versions=true の場合は noncurrent な Generation も返す
+func (s *server) listObjects(w http.ResponseWriter, ar *apiRequest) {
+	q, err := parseListQuery(ar.query)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	objects, err := s.store.listObjects(ar.bucket, q.versions)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	res, err := listObjects(objects, q)
+	if err != nil {
+		writeError(w, ar, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &apigcs.Objects{
+		Kind:          "storage#objects",
+		Items:         res.items,
+		Prefixes:      res.prefixes,
+		NextPageToken: res.nextPageToken,
+	})
+}
+
+// readMultipartUpload is uploadType=multipart の body を Object の metadata と中身に分ける
+// 1つ目の part が metadata の JSON で、2つ目の part が Object の中身になっている
+func readMultipartUpload(r *http.Request) (*apigcs.Object, io.Reader, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	metaPart, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, fmt.Errorf("metadata part is not found : %w", err)
+	}
+	var attrs apigcs.Object
+	if err := json.NewDecoder(metaPart).Decode(&attrs); err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata part : %w", err)
+	}
+
+	mediaPart, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, fmt.Errorf("media part is not found : %w", err)
+	}
+	if attrs.ContentType == "" {
+		attrs.ContentType = mediaPart.Header.Get("Content-Type")
+	}
+	return &attrs, mediaPart, nil
+}
+
+// readXMLUpload is XML API の PUT Object の body と Header を Object の metadata と中身にする
+// metadata は Content-Type などの Header と x-goog-meta- で始まる Header で指定する
+func readXMLUpload(r *http.Request, ar *apiRequest) (*apigcs.Object, io.Reader, error) {
+	attrs := &apigcs.Object{
+		Name:               ar.object,
+		ContentType:        r.Header.Get("Content-Type"),
+		ContentEncoding:    r.Header.Get("Content-Encoding"),
+		ContentDisposition: r.Header.Get("Content-Disposition"),
+		ContentLanguage:    r.Header.Get("Content-Language"),
+		CacheControl:       r.Header.Get("Cache-Control"),
+		StorageClass:       r.Header.Get("X-Goog-Storage-Class"),
+		Md5Hash:            r.Header.Get("Content-MD5"),
+	}
+	for k, v := range r.Header {
+		if name := strings.TrimPrefix(strings.ToLower(k), "x-goog-meta-"); name != strings.ToLower(k) && len(v) > 0 {
+			if attrs.Metadata == nil {
+				attrs.Metadata = make(map[string]string)
+			}
+			attrs.Metadata[name] = v[0]
+		}
+	}
+	return attrs, r.Body, nil
+}
+
+// setUploadHeader is XML API の PUT Object の Response の Header を設定する
+// XML API の Upload は body を返さず、Generation や Hash を Header で返す
+func setUploadHeader(h http.Header, attrs *apigcs.Object) {
+	if md5, err := base64.StdEncoding.DecodeString(attrs.Md5Hash); err == nil && len(md5) > 0 {
+		h.Set("ETag", fmt.Sprintf("%q", hex.EncodeToString(md5)))
+	}
+	h.Set("X-Goog-Generation", strconv.FormatInt(attrs.Generation, 10))
+	h.Set("X-Goog-Metageneration", strconv.FormatInt(attrs.Metageneration, 10))
+	setHashHeader(h, attrs)
+	h.Set("Content-Length", "0")
+}
+
+// setObjectHeader is Object の中身を返す時の Header を設定する
+func setObjectHeader(h http.Header, attrs *apigcs.Object) {
+	contentType := attrs.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("X-Goog-Generation", strconv.FormatInt(attrs.Generation, 10))
+	h.Set("X-Goog-Metageneration", strconv.FormatInt(attrs.Metageneration, 10))
+	h.Set("X-Goog-Storage-Class", attrs.StorageClass)
+	h.Set("X-Goog-Stored-Content-Length", strconv.FormatUint(attrs.Size, 10))
+	setHashHeader(h, attrs)
+	if attrs.ContentEncoding != "" {
+		h.Set("Content-Encoding", attrs.ContentEncoding)
+		h.Set("X-Goog-Stored-Content-Encoding", attrs.ContentEncoding)
+	} else {
+		h.Set("X-Goog-Stored-Content-Encoding", "identity")
+	}
+	if attrs.CacheControl != "" {
+		h.Set("Cache-Control", attrs.CacheControl)
+	}
+	if attrs.ContentDisposition != "" {
+		h.Set("Content-Disposition", attrs.ContentDisposition)
+	}
+	if attrs.ContentLanguage != "" {
+		h.Set("Content-Language", attrs.ContentLanguage)
+	}
+	if updated, err := time.Parse(time.RFC3339Nano, attrs.Updated); err == nil {
+		h.Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+	for k, v := range attrs.Metadata {
+		h.Set("X-Goog-Meta-"+k, v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+// writeError is GCS と同じ形式で error を返す
+// JSON API には googleapi.Error として解釈できる JSON を、XML API には XML を返す
+func writeError(w http.ResponseWriter, ar *apiRequest, err error) {
+	se := storeErrorOf(err)
+	if ar.xml {
+		w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+		w.WriteHeader(se.code)
+		if ar.method == http.MethodHead {
+			return
+		}
+		b, _ := xml.Marshal(&xmlError{Code: xmlErrorCode(se), Message: se.message})
+		_, _ = io.WriteString(w, xml.Header)
+		_, _ = w.Write(b)
+		return
+	}
+	writeJSON(w, se.code, jsonErrorBody(se))
+}
+
+// newErrorResponse is writeError と同じ内容の http.Response を作る
+func newErrorResponse(ar *apiRequest, err error, header http.Header) *http.Response {
+	rec := httptest.NewRecorder()
+	for k, v := range header {
+		rec.Header()[k] = v
+	}
+	writeError(rec, ar, err)
+	return rec.Result()
+}
+
+// storeErrorOf is err を storeError に変換する
+// storeError ではない error は 500 として扱う
+func storeErrorOf(err error) *storeError {
+	var se *storeError
+	if errors.As(err, &se) {
+		return se
+	}
+	var ue *UnmatchedRequestError
+	if errors.As(err, &ue) {
+		return ue.storeError()
+	}
+	return &storeError{
+		code:    http.StatusInternalServerError,
+		reason:  "backendError",
+		message: err.Error(),
+	}
+}
+
+// jsonErrorBody is JSON API の error の body を返す
+func jsonErrorBody(err error) map[string]interface{} {
+	se := storeErrorOf(err)
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    se.code,
+			"message": se.message,
+			"errors": []map[string]interface{}{
+				{
+					"domain":  "global",
+					"reason":  se.reason,
+					"message": se.message,
+				},
+			},
+		},
+	}
+}
+
+type xmlError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// xmlErrorCode is XML API の Error Code を返す
+func xmlErrorCode(se *storeError) string {
+	if se.xmlCode != "" {
+		return se.xmlCode
+	}
+	switch se.code {
+	case http.StatusNotFound:
+		return "NoSuchKey"
+	case http.StatusBadRequest:
+		return "InvalidArgument"
+	case http.StatusForbidden:
+		return "AccessDenied"
+	case http.StatusPreconditionFailed:
+		return "PreconditionFailed"
+	case http.StatusRequestedRangeNotSatisfiable:
+		return "InvalidRange"
+	default:
+		return http.StatusText(se.code)
+	}
+}
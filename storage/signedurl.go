@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	signedURLAlgorithm  = "GOOG4-RSA-SHA256"
+	signedURLTimeFormat = "20060102T150405Z"
+
+	// maxSignedURLExpires is V4 Signed URL の有効期限の最大値で、7日間
+	maxSignedURLExpires = 7 * 24 * time.Hour
+)
+
+// SignedURLServer is V4 Signed URL と POST Policy を検証して、Faker で Request を処理する httptest.Server
+//
+// storage.SignedURL で発行した URL に実際に HTTP で Request することで、
+// Signed URL を発行する処理と、それを使って Upload や Download する処理をまとめて確認できる
+// Signed URL は STORAGE_EMULATOR_HOST に Server の Host を設定し、Insecure を true にして PathStyle で発行する
+type SignedURLServer struct {
+	*httptest.Server
+
+	faker *Faker
+
+	mu sync.RWMutex
+	// keys is GoogleAccessID ごとの Signed URL の署名を検証する公開鍵
+	keys map[string]*rsa.PublicKey
+}
+
+// NewSignedURLServer is faker で Request を処理する SignedURLServer を起動する
+// Server は t.Cleanup で閉じる
+func NewSignedURLServer(t *testing.T, faker *Faker) *SignedURLServer {
+	t.Helper()
+
+	s := NewSignedURLServerWithoutTesting(faker)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// NewSignedURLServerWithoutTesting is testing.T を使わずに NewSignedURLServer と同じ Server を起動する
+// 使い終わったら Close を呼ぶ
+func NewSignedURLServerWithoutTesting(faker *Faker) *SignedURLServer {
+	s := &SignedURLServer{
+		faker: faker,
+		keys:  make(map[string]*rsa.PublicKey),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddServiceAccountKey is googleAccessID の Service Account の鍵を登録する
+// key は SignedURLOptions.PrivateKey と同じ PEM 形式の秘密鍵か、PEM 形式の公開鍵か証明書
+func (s *SignedURLServer) AddServiceAccountKey(googleAccessID string, key []byte) error {
+	pub, err := parsePublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[googleAccessID] = pub
+	return nil
+}
+
+// parsePublicKey is PEM 形式の鍵から署名の検証に使う公開鍵を取り出す
+func parsePublicKey(key []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, fmt.Errorf("key is not PEM encoded")
+	}
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			parsed = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey, nil
+	case *rsa.PublicKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("key is not RSA key")
+}
+
+// serveHTTP is Signed URL を検証してから、Faker の Transport で Request を処理する
+// 登録された Response と stateful mode の store のどちらも、storage.googleapis.com への Request として扱う
+func (s *SignedURLServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ar := parseRequest(r)
+	ar.xml = true
+	if isPostPolicyRequest(r) {
+		s.servePostPolicy(w, r, ar)
+		return
+	}
+	if err := s.verify(r); err != nil {
+		writeError(w, ar, err)
+		return
+	}
+
+	q := r.URL.Query()
+	for k := range q {
+		if strings.HasPrefix(k, "X-Goog-") {
+			q.Del(k)
+		}
+	}
+	r.URL.RawQuery = q.Encode()
+	s.faker.serveHTTP(w, r)
+}
+
+func errSignatureDoesNotMatch(message string) error {
+	return &storeError{
+		code:    http.StatusForbidden,
+		reason:  "forbidden",
+		message: message,
+		xmlCode: "SignatureDoesNotMatch",
+	}
+}
+
+func errExpiredToken(message string) error {
+	return &storeError{
+		code:    http.StatusBadRequest,
+		reason:  "invalid",
+		message: message,
+		xmlCode: "ExpiredToken",
+	}
+}
+
+func errAuthenticationRequired() error {
+	return &storeError{
+		code:    http.StatusForbidden,
+		reason:  "forbidden",
+		message: "Anonymous caller does not have access to the requested resource.",
+		xmlCode: "AccessDenied",
+	}
+}
+
+// verify is Request の Signed URL の署名と有効期限を確認する
+// 有効期限は Faker の仮想的な時刻で判定するので、AdvanceTime で期限切れの URL を作れる
+func (s *SignedURLServer) verify(r *http.Request) error {
+	q := r.URL.Query()
+	signature := q.Get("X-Goog-Signature")
+	if signature == "" {
+		return errAuthenticationRequired()
+	}
+	if v := q.Get("X-Goog-Algorithm"); v != signedURLAlgorithm {
+		return errInvalid(fmt.Sprintf("Unsupported X-Goog-Algorithm %q", v))
+	}
+	credential := strings.SplitN(q.Get("X-Goog-Credential"), "/", 2)
+	if len(credential) != 2 {
+		return errInvalid(fmt.Sprintf("Invalid X-Goog-Credential %q", q.Get("X-Goog-Credential")))
+	}
+	date, err := time.Parse(signedURLTimeFormat, q.Get("X-Goog-Date"))
+	if err != nil {
+		return errInvalid(fmt.Sprintf("Invalid X-Goog-Date %q", q.Get("X-Goog-Date")))
+	}
+	expires, err := strconv.Atoi(q.Get("X-Goog-Expires"))
+	if err != nil || expires <= 0 || time.Duration(expires)*time.Second > maxSignedURLExpires {
+		return errInvalid(fmt.Sprintf("Invalid X-Goog-Expires %q", q.Get("X-Goog-Expires")))
+	}
+	if expiration := date.Add(time.Duration(expires) * time.Second); !s.faker.now().Before(expiration) {
+		return errExpiredToken(fmt.Sprintf("Invalid argument. Request signature expired at: %s", expiration.Format(time.RFC3339)))
+	}
+
+	s.mu.RLock()
+	key, ok := s.keys[credential[0]]
+	s.mu.RUnlock()
+	if !ok {
+		return errSignatureDoesNotMatch(fmt.Sprintf("Service account %s is not registered.", credential[0]))
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return errSignatureDoesNotMatch("X-Goog-Signature is not hex encoded.")
+	}
+	// cloud.google.com/go/storage は host の Header の値を : で区切ってしまい、Port を落として署名するので、Port 無しの Host でも確認する
+	hosts := []string{r.Host}
+	if i := strings.LastIndex(r.Host, ":"); i > 0 {
+		hosts = append(hosts, r.Host[:i])
+	}
+	var canonicalRequest string
+	for _, host := range hosts {
+		canonicalRequest = canonicalRequestV4(r, host)
+		sum := sha256.Sum256([]byte(canonicalRequest))
+		stringToSign := strings.Join([]string{signedURLAlgorithm, q.Get("X-Goog-Date"), credential[1], hex.EncodeToString(sum[:])}, "\n")
+		digest := sha256.Sum256([]byte(stringToSign))
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err == nil {
+			return nil
+		}
+	}
+	return errSignatureDoesNotMatch(fmt.Sprintf("The request signature we calculated does not match the signature you provided. Check your Google secret key and signing method.\n%s", canonicalRequest))
+}
+
+// canonicalRequestV4 is Request から V4 署名の Canonical Request を組み立てる
+// host の Header の値は host を使う
+// X-Goog-SignedHeaders に含まれる Header だけを使うので、署名していない Header を追加しても署名は変わらない
+func canonicalRequestV4(r *http.Request, host string) string {
+	q := r.URL.Query()
+	signedHeaders := q.Get("X-Goog-SignedHeaders")
+	q.Del("X-Goog-Signature")
+
+	var headers []string
+	payload := "UNSIGNED-PAYLOAD"
+	names := strings.Split(signedHeaders, ";")
+	sort.Strings(names)
+	for _, name := range names {
+		var value string
+		if name == "host" {
+			value = host
+		} else {
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		value = strings.Join(strings.Fields(value), " ")
+		headers = append(headers, fmt.Sprintf("%s:%s", name, value))
+		if name == "x-goog-content-sha256" {
+			payload = value
+		}
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Replace(q.Encode(), "+", "%20", -1),
+		strings.Join(headers, "\n"),
+		"",
+		signedHeaders,
+		payload,
+	}, "\n")
+}
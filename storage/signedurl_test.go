@@ -0,0 +1,157 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+const signedURLAccessID = "signer@sinmetal-ci.iam.gserviceaccount.com"
+
+func newSignedURLServer(t *testing.T, faker *storagefaker.Faker) (*storagefaker.SignedURLServer, []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	srv := storagefaker.NewSignedURLServer(t, faker)
+	if err := srv.AddServiceAccountKey(signedURLAccessID, pemKey); err != nil {
+		t.Fatal(err)
+	}
+	// PathStyle の Signed URL は STORAGE_EMULATOR_HOST を Host にする
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.Listener.Addr().String())
+	return srv, pemKey
+}
+
+func signedURL(t *testing.T, pemKey []byte, method string, object string, contentType string, expires time.Duration) string {
+	t.Helper()
+
+	u, err := storage.SignedURL("sinmetal-ci-fake", object, &storage.SignedURLOptions{
+		GoogleAccessID: signedURLAccessID,
+		PrivateKey:     pemKey,
+		Method:         method,
+		ContentType:    contentType,
+		Expires:        time.Now().Add(expires),
+		Scheme:         storage.SigningSchemeV4,
+		Insecure:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func doSignedURLRequest(t *testing.T, method string, u string, contentType string, body string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+func assertXMLErrorCode(t *testing.T, res *http.Response, body string, status int, code string) {
+	t.Helper()
+
+	if e, g := status, res.StatusCode; e != g {
+		t.Errorf("want status %d but got %d", e, g)
+	}
+	var v struct {
+		Code string `xml:"Code"`
+	}
+	if err := xml.NewDecoder(bytes.NewBufferString(body)).Decode(&v); err != nil {
+		t.Fatalf("invalid XML error %q : %v", body, err)
+	}
+	if e, g := code, v.Code; e != g {
+		t.Errorf("want code %s but got %s", e, g)
+	}
+}
+
+func TestSignedURLServer_UploadAndDownload(t *testing.T) {
+	faker, stg := newStatefulClient(t)
+	_, pemKey := newSignedURLServer(t, faker)
+
+	const object = "signed/hello world.txt"
+	u := signedURL(t, pemKey, http.MethodPut, object, "text/plain", time.Hour)
+	res, body := doSignedURLRequest(t, http.MethodPut, u, "text/plain", "Hello Signed URL")
+	if e, g := http.StatusOK, res.StatusCode; e != g {
+		t.Fatalf("want status %d but got %d. %s", e, g, body)
+	}
+	if e, g := "Hello Signed URL", readObject(t, stg, "sinmetal-ci-fake", object); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+
+	u = signedURL(t, pemKey, http.MethodGet, object, "", time.Hour)
+	res, body = doSignedURLRequest(t, http.MethodGet, u, "", "")
+	if e, g := http.StatusOK, res.StatusCode; e != g {
+		t.Fatalf("want status %d but got %d. %s", e, g, body)
+	}
+	if e, g := "Hello Signed URL", body; e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+	if e, g := "text/plain", res.Header.Get("Content-Type"); e != g {
+		t.Errorf("want Content-Type %s but got %s", e, g)
+	}
+}
+
+func TestSignedURLServer_Rejected(t *testing.T) {
+	faker, stg := newStatefulClient(t)
+	_, pemKey := newSignedURLServer(t, faker)
+	writeObject(t, stg, "sinmetal-ci-fake", "secret.txt", "secret")
+
+	t.Run("other object", func(t *testing.T) {
+		u := signedURL(t, pemKey, http.MethodGet, "public.txt", "", time.Hour)
+		res, body := doSignedURLRequest(t, http.MethodGet, strings.Replace(u, "public.txt", "secret.txt", 1), "", "")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "SignatureDoesNotMatch")
+	})
+	t.Run("other method", func(t *testing.T) {
+		u := signedURL(t, pemKey, http.MethodGet, "secret.txt", "", time.Hour)
+		res, body := doSignedURLRequest(t, http.MethodPut, u, "", "overwrite")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "SignatureDoesNotMatch")
+	})
+	t.Run("signed header", func(t *testing.T) {
+		u := signedURL(t, pemKey, http.MethodPut, "upload.txt", "text/plain", time.Hour)
+		res, body := doSignedURLRequest(t, http.MethodPut, u, "application/json", "{}")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "SignatureDoesNotMatch")
+	})
+	t.Run("unsigned", func(t *testing.T) {
+		u := signedURL(t, pemKey, http.MethodGet, "secret.txt", "", time.Hour)
+		res, body := doSignedURLRequest(t, http.MethodGet, u[:strings.Index(u, "?")], "", "")
+		assertXMLErrorCode(t, res, body, http.StatusForbidden, "AccessDenied")
+	})
+	t.Run("expired", func(t *testing.T) {
+		u := signedURL(t, pemKey, http.MethodGet, "secret.txt", "", time.Hour)
+		if err := faker.AdvanceTime(2 * time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		res, body := doSignedURLRequest(t, http.MethodGet, u, "", "")
+		assertXMLErrorCode(t, res, body, http.StatusBadRequest, "ExpiredToken")
+	})
+}
@@ -0,0 +1,192 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func newStatefulClient(t *testing.T) (*storagefaker.Faker, *storage.Client) {
+	t.Helper()
+
+	faker := storagefaker.NewStatefulFaker(t)
+	stg, err := storage.NewClient(context.Background(), option.WithHTTPClient(faker.Client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return faker, stg
+}
+
+func writeObject(t *testing.T, stg *storage.Client, bucket string, object string, body string) *storage.ObjectAttrs {
+	t.Helper()
+
+	w := stg.Bucket(bucket).Object(object).NewWriter(context.Background())
+	w.ContentType = "text/plain"
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.Attrs()
+}
+
+func readObject(t *testing.T, stg *storage.Client, bucket string, object string) string {
+	t.Helper()
+
+	r, err := stg.Bucket(bucket).Object(object).NewReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestStatefulFaker_WriteAndRead(t *testing.T) {
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	cases := []struct {
+		name   string
+		object string
+		body   string
+	}{
+		{"simple", "hoge.txt", `{"message":"Hello Hoge"}`},
+		{"slash", "dir/sub/hoge.txt", `{"message":"Hello Dir"}`},
+		{"unicode", "ディレクトリ/ほげ.txt", `{"message":"こんにちは"}`},
+		{"empty", "empty.txt", ""},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			attrs := writeObject(t, stg, bucket, tt.object, tt.body)
+			if e, g := int64(len(tt.body)), attrs.Size; e != g {
+				t.Errorf("want size %d but got %d", e, g)
+			}
+			if attrs.Generation == 0 {
+				t.Error("generation is zero")
+			}
+			if e, g := tt.body, readObject(t, stg, bucket, tt.object); e != g {
+				t.Errorf("want body %q but got %q", e, g)
+			}
+		})
+	}
+}
+
+func TestStatefulFaker_AttrsUpdateDelete(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "hoge.txt"
+	writeObject(t, stg, bucket, object, "hello")
+	obj := stg.Bucket(bucket).Object(object)
+
+	attrs, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{
+		ContentType: "application/json",
+		Metadata:    map[string]string{"hoge": "fuga"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := int64(2), attrs.Metageneration; e != g {
+		t.Errorf("want metageneration %d but got %d", e, g)
+	}
+
+	got, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "application/json", got.ContentType; e != g {
+		t.Errorf("want contentType %s but got %s", e, g)
+	}
+	if e, g := map[string]string{"hoge": "fuga"}, got.Metadata; !cmp.Equal(e, g) {
+		t.Errorf("want metadata %v but got %v", e, g)
+	}
+
+	if _, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Metadata) != 0 {
+		t.Errorf("want empty metadata but got %v", got.Metadata)
+	}
+
+	if err := obj.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("want ErrObjectNotExist but got %v", err)
+	}
+	if _, err := obj.NewReader(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("want ErrObjectNotExist but got %v", err)
+	}
+	if err := obj.Delete(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("want ErrObjectNotExist but got %v", err)
+	}
+}
+
+func TestStatefulFaker_ListObjects(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	for _, name := range []string{"b.txt", "a/1.txt", "a/2.txt", "c.txt"} {
+		writeObject(t, stg, bucket, name, name)
+	}
+
+	var got []string
+	it := stg.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: "a/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, attrs.Name)
+	}
+	if e := []string{"a/1.txt", "a/2.txt"}; !cmp.Equal(e, got) {
+		t.Errorf("want %v but got %v", e, got)
+	}
+}
+
+// TestStatefulFaker_RegisteredResponseFirst is 登録された Response がある時は in-memory な GCS よりも優先されることを確認する
+func TestStatefulFaker_RegisteredResponseFirst(t *testing.T) {
+	faker, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "hoge.txt"
+	writeObject(t, stg, bucket, object, "stored")
+
+	if err := faker.AddGetObjectResponse(bucket, object, storagefaker.GetObjectOKResponseSample()); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := `{"message":"Hello Hoge"}`, readObject(t, stg, bucket, object); e != g {
+		t.Errorf("want registered body %q but got %q", e, g)
+	}
+	if e, g := "stored", readObject(t, stg, bucket, object); e != g {
+		t.Errorf("want stored body %q but got %q", e, g)
+	}
+}
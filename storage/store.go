@@ -0,0 +1,584 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apigcs "google.golang.org/api/storage/v1"
+)
+
+// store is stateful mode で Bucket と Object を保持する in-memory な GCS
+// Bucket は Object が書き込まれた時に暗黙的に作成される
+// Object の中身は backend に保存する
+type store struct {
+	mu sync.RWMutex
+
+	buckets map[string]*bucketEntry
+
+	backend Backend
+
+	// now is 現在時刻を返す
+	// 実際の時刻に clockOffset を足した仮想的な時刻になっている
+	now func() time.Time
+
+	// clockOffset is AdvanceTime で進めた時間の合計
+	clockOffset time.Duration
+
+	// lastGeneration is 最後に払い出した Generation
+	// Generation は時刻から作るが、同じ時刻に複数払い出した時に重複しないようにする
+	lastGeneration int64
+}
+
+type bucketEntry struct {
+	attrs *apigcs.Bucket
+
+	// project is buckets.insert の project で指定された Project
+	// Object の書き込みや Seed で暗黙的に作成された Bucket は空で、全ての Project の Bucket として扱う
+	project string
+
+	// objects is Object 名ごとの最新の Generation
+	objects map[string]*objectEntry
+
+	// noncurrent is Versioning が有効な Bucket で上書きや削除された古い Generation
+	// Object 名ごとに Generation 順に並んでいる
+	noncurrent map[string][]*objectEntry
+}
+
+type objectEntry struct {
+	attrs *apigcs.Object
+	blob  *storedBlob
+}
+
+// storedBlob is store の Object や Upload Session から参照されている Blob
+// rewrite でコピーした Object や noncurrent な Generation は同じ Blob を共有するので、参照している数を数えて
+// 最後の参照が手放された時に Release する
+type storedBlob struct {
+	Blob
+
+	refs atomic.Int64
+}
+
+// newStoredBlob is backend に書き込んだ blob を、作成した呼び出し元が 1 つ参照している storedBlob にする
+// 呼び出し元は store に渡し終わったら drop する
+func newStoredBlob(blob Blob) *storedBlob {
+	b := &storedBlob{Blob: blob}
+	b.refs.Store(1)
+	return b
+}
+
+// retain is 参照を 1 つ増やす
+// 既に最後の参照が手放されて Release されている場合は増やさずに false を返す
+func (b *storedBlob) retain() bool {
+	for {
+		n := b.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if b.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// drop is 参照を 1 つ減らして、最後の参照だった場合は Release する
+func (b *storedBlob) drop() {
+	if b.refs.Add(-1) == 0 {
+		_ = b.Release()
+	}
+}
+
+func newStore(backend Backend) *store {
+	s := &store{
+		buckets: make(map[string]*bucketEntry),
+		backend: backend,
+	}
+	s.now = func() time.Time {
+		return time.Now().Add(s.clockOffset)
+	}
+	return s
+}
+
+// storeError is store の操作が失敗した時の error
+// GCS が返す HTTP Status Code と reason を保持している
+type storeError struct {
+	code    int
+	reason  string
+	message string
+
+	// xmlCode is XML API の Error Code
+	// 空の場合は code から決める
+	xmlCode string
+}
+
+func (e *storeError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.code, e.reason, e.message)
+}
+
+func errBucketNotFound() error {
+	return &storeError{
+		code:    http.StatusNotFound,
+		reason:  "notFound",
+		message: "The specified bucket does not exist.",
+	}
+}
+
+func errObjectNotFound(bucket string, object string) error {
+	return &storeError{
+		code:    http.StatusNotFound,
+		reason:  "notFound",
+		message: fmt.Sprintf("No such object: %s/%s", bucket, object),
+	}
+}
+
+func errInvalid(message string) error {
+	return &storeError{
+		code:    http.StatusBadRequest,
+		reason:  "invalid",
+		message: message,
+	}
+}
+
+// getObject is Object の Attrs と中身を返す
+// 返す値は Copy なので、呼び出し元で変更しても store には影響しない
+func (s *store) getObject(bucket string, object string, cond *conditions) (*objectEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, err := s.lookupObject(bucket, object, cond)
+	if err != nil {
+		return nil, err
+	}
+	return o.clone(), nil
+}
+
+// putObject is content を最後まで読んで backend に書き込み、Object を作成する
+// attrs の中で Client が指定できる項目だけを使い、Generation などの Server が決める項目は store が埋める
+// cond の Precondition は書き込む前の Object に対して確認する
+// content は Lock を取らずに読むので、大きな Object の Upload 中も他の操作はブロックしない
+func (s *store) putObject(bucket string, attrs *apigcs.Object, content io.Reader, cond *conditions) (*apigcs.Object, error) {
+	if attrs.Name == "" {
+		return nil, errInvalid("Required object name is missing.")
+	}
+	blob, hash, err := writeBlob(s.backend, content)
+	if err != nil {
+		return nil, err
+	}
+	sb := newStoredBlob(blob)
+	defer sb.drop()
+	return s.putBlob(bucket, attrs, sb, hash, cond)
+}
+
+// putBlob is backend に書き込み済みの blob を中身として Object を作成する
+// hash は blob の中身の objectHash
+// 呼び出し元は blob の参照を持ったまま呼び、Object は別に参照を持つ
+func (s *store) putBlob(bucket string, attrs *apigcs.Object, blob *storedBlob, hash *objectHash, cond *conditions) (*apigcs.Object, error) {
+	if attrs.Name == "" {
+		return nil, errInvalid("Required object name is missing.")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, err := s.writeObject(bucket, attrs, blob, hash, cond)
+	if err != nil {
+		return nil, err
+	}
+	return obj.clone().attrs, nil
+}
+
+// copyObject is objects.rewrite でコピーした blob を中身として Object を作成する
+// Upload と違ってコピー先の Bucket を暗黙的に作成せず、存在しない場合は 404 を返す
+func (s *store) copyObject(bucket string, attrs *apigcs.Object, blob *storedBlob, hash *objectHash, cond *conditions) (*apigcs.Object, error) {
+	if attrs.Name == "" {
+		return nil, errInvalid("Required object name is missing.")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucket]; !ok {
+		return nil, errBucketNotFound()
+	}
+	obj, err := s.writeObject(bucket, attrs, blob, hash, cond)
+	if err != nil {
+		return nil, err
+	}
+	return obj.clone().attrs, nil
+}
+
+// writeObject is putBlob の本体で、書き込んだ Object を返す
+// s.mu の Lock を取った状態で、呼び出し元が blob の参照を持ったまま呼ぶ
+func (s *store) writeObject(bucket string, attrs *apigcs.Object, blob *storedBlob, hash *objectHash, cond *conditions) (*objectEntry, error) {
+	if err := hash.verify(attrs); err != nil {
+		return nil, err
+	}
+	var current *apigcs.Object
+	if b, ok := s.buckets[bucket]; ok {
+		if o, ok := b.objects[attrs.Name]; ok {
+			current = o.attrs
+		}
+	}
+	if err := cond.check(current); err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	b := s.bucket(bucket, now)
+	if current, ok := b.objects[attrs.Name]; ok {
+		if err := b.checkRetention(current, now); err != nil {
+			return nil, err
+		}
+		b.archive(current, now)
+	}
+	blob.retain()
+	obj := &objectEntry{
+		attrs: &apigcs.Object{
+			Bucket:             bucket,
+			Name:               attrs.Name,
+			ContentType:        attrs.ContentType,
+			ContentEncoding:    attrs.ContentEncoding,
+			ContentDisposition: attrs.ContentDisposition,
+			ContentLanguage:    attrs.ContentLanguage,
+			CacheControl:       attrs.CacheControl,
+			CustomTime:         attrs.CustomTime,
+			Metadata:           attrs.Metadata,
+			StorageClass:       attrs.StorageClass,
+			TemporaryHold:      attrs.TemporaryHold,
+			EventBasedHold:     attrs.EventBasedHold || b.attrs.DefaultEventBasedHold,
+			Acl:                cloneObjectACL(attrs.Acl),
+			Owner:              &apigcs.ObjectOwner{Entity: fakeOwnerEntity},
+		},
+		blob: blob,
+	}
+	if len(obj.attrs.Acl) == 0 {
+		// ACL を指定していない場合は Bucket の Default Object ACL と、作成した User の OWNER になる
+		obj.attrs.Acl = setACLRule(cloneObjectACL(b.attrs.DefaultObjectAcl), &apigcs.ObjectAccessControl{Entity: fakeOwnerEntity, Role: "OWNER"})
+	}
+	if obj.attrs.StorageClass == "" {
+		obj.attrs.StorageClass = "STANDARD"
+	}
+	obj.attrs.Generation = s.nextGeneration(now)
+	obj.attrs.Metageneration = 1
+	obj.attrs.Size = uint64(blob.Size())
+	obj.attrs.Md5Hash = hash.md5
+	obj.attrs.Crc32c = hash.crc32c
+	obj.attrs.TimeCreated = now.UTC().Format(time.RFC3339Nano)
+	obj.attrs.TimeStorageClassUpdated = obj.attrs.TimeCreated
+	obj.attrs.Updated = obj.attrs.TimeCreated
+	b.applyRetention(obj, now)
+	obj.fillDerivedAttrs()
+
+	b.objects[attrs.Name] = obj
+	return obj, nil
+}
+
+// patchObject is Object の Attrs を JSON Merge Patch (RFC 7396) で更新する
+// Object.Patch の body は変更する項目だけを含み、削除する項目は null になっている
+func (s *store) patchObject(bucket string, object string, patch []byte, cond *conditions) (*apigcs.Object, error) {
+	var p map[string]interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, errInvalid(err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, err := s.lookupObject(bucket, object, cond)
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := mergePatchObject(o.attrs, p)
+	if err != nil {
+		return nil, err
+	}
+	eventBasedHold := o.attrs.EventBasedHold
+	o.attrs = updated
+	now := s.now()
+	s.buckets[bucket].releaseHold(o, eventBasedHold, now)
+	o.touch(now)
+	return o.clone().attrs, nil
+}
+
+// updateObject is Object の変更可能な Attrs を全て置き換える
+func (s *store) updateObject(bucket string, object string, attrs *apigcs.Object, cond *conditions) (*apigcs.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, err := s.lookupObject(bucket, object, cond)
+	if err != nil {
+		return nil, err
+	}
+
+	o.attrs.ContentType = attrs.ContentType
+	o.attrs.ContentEncoding = attrs.ContentEncoding
+	o.attrs.ContentDisposition = attrs.ContentDisposition
+	o.attrs.ContentLanguage = attrs.ContentLanguage
+	o.attrs.CacheControl = attrs.CacheControl
+	o.attrs.CustomTime = attrs.CustomTime
+	o.attrs.Metadata = attrs.Metadata
+	if attrs.Acl != nil {
+		o.attrs.Acl = attrs.Acl
+	}
+	eventBasedHold := o.attrs.EventBasedHold
+	o.attrs.TemporaryHold = attrs.TemporaryHold
+	o.attrs.EventBasedHold = attrs.EventBasedHold
+	now := s.now()
+	s.buckets[bucket].releaseHold(o, eventBasedHold, now)
+	o.touch(now)
+	return o.clone().attrs, nil
+}
+
+// deleteObject is Object を削除する
+// Versioning が有効な Bucket では最新の Generation は削除せずに noncurrent にする
+// generation を指定した場合は、その Generation を完全に削除する
+func (s *store) deleteObject(bucket string, object string, cond *conditions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, err := s.lookupObject(bucket, object, cond)
+	if err != nil {
+		return err
+	}
+	b := s.buckets[bucket]
+	now := s.now()
+	if err := b.checkRetention(o, now); err != nil {
+		return err
+	}
+	if b.objects[object] != o {
+		b.removeNoncurrent(o)
+		return nil
+	}
+	delete(b.objects, object)
+	if cond == nil || cond.generation == nil {
+		b.archive(o, now)
+		return nil
+	}
+	o.blob.drop()
+	return nil
+}
+
+// listObjects is Bucket の中の Object の Attrs を名前順、同じ名前の場合は Generation 順に返す
+// versions が true の場合は noncurrent な Generation も含める
+// 絞り込みや page 分けは呼び出し元で行う
+func (s *store) listObjects(bucket string, versions bool) ([]*apigcs.Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return nil, errBucketNotFound()
+	}
+	var l []*apigcs.Object
+	for _, o := range b.objects {
+		l = append(l, o.clone().attrs)
+	}
+	if versions {
+		for _, generations := range b.noncurrent {
+			for _, o := range generations {
+				l = append(l, o.clone().attrs)
+			}
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Name != l[j].Name {
+			return l[i].Name < l[j].Name
+		}
+		return l[i].Generation < l[j].Generation
+	})
+	return l, nil
+}
+
+// lookupObject is 操作対象の Object を探して、Precondition を満たしているかを確認する
+// cond で generation が指定されている場合は、その Generation の Object だけを対象にする
+// s.mu の Lock を取った状態で呼ぶ
+func (s *store) lookupObject(bucket string, object string, cond *conditions) (*objectEntry, error) {
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return nil, errBucketNotFound()
+	}
+	o, ok := b.objects[object]
+	if cond != nil && cond.generation != nil && (!ok || !cond.selects(o.attrs)) {
+		o, ok = nil, false
+		for _, v := range b.noncurrent[object] {
+			if cond.selects(v.attrs) {
+				o, ok = v, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, errObjectNotFound(bucket, object)
+	}
+	if err := cond.check(o.attrs); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// bucket is Bucket を返す
+// 存在しない場合は作成する
+// s.mu の Lock を取った状態で呼ぶ
+func (s *store) bucket(name string, now time.Time) *bucketEntry {
+	b, ok := s.buckets[name]
+	if !ok {
+		b = newBucketEntry(&apigcs.Bucket{Name: name}, now)
+		s.buckets[name] = b
+	}
+	return b
+}
+
+// archive is 上書きや削除された Object を Versioning が有効な場合は noncurrent として残す
+// Versioning が無効な場合は Object はそのまま消えるので、中身の参照を手放す
+func (b *bucketEntry) archive(o *objectEntry, now time.Time) {
+	if b.attrs.Versioning == nil || !b.attrs.Versioning.Enabled {
+		o.blob.drop()
+		return
+	}
+	o.attrs.TimeDeleted = now.UTC().Format(time.RFC3339Nano)
+	b.noncurrent[o.attrs.Name] = append(b.noncurrent[o.attrs.Name], o)
+}
+
+// removeNoncurrent is noncurrent な Generation を完全に削除して、中身の参照を手放す
+func (b *bucketEntry) removeNoncurrent(o *objectEntry) {
+	o.blob.drop()
+	name := o.attrs.Name
+	var l []*objectEntry
+	for _, v := range b.noncurrent[name] {
+		if v != o {
+			l = append(l, v)
+		}
+	}
+	if len(l) == 0 {
+		delete(b.noncurrent, name)
+		return
+	}
+	b.noncurrent[name] = l
+}
+
+// nextGeneration is GCS と同じように micro second の時刻を Generation として払い出す
+// s.mu の Lock を取った状態で呼ぶ
+func (s *store) nextGeneration(now time.Time) int64 {
+	gen := now.UnixMicro()
+	if gen <= s.lastGeneration {
+		gen = s.lastGeneration + 1
+	}
+	s.lastGeneration = gen
+	return gen
+}
+
+// fillDerivedAttrs is Bucket, Name, Generation から決まる Attrs を埋める
+func (o *objectEntry) fillDerivedAttrs() {
+	a := o.attrs
+	escaped := url.PathEscape(a.Name)
+	a.Kind = "storage#object"
+	a.Id = fmt.Sprintf("%s/%s/%d", a.Bucket, a.Name, a.Generation)
+	a.SelfLink = fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s", a.Bucket, escaped)
+	a.MediaLink = fmt.Sprintf("https://storage.googleapis.com/download/storage/v1/b/%s/o/%s?generation=%d&alt=media", a.Bucket, escaped, a.Generation)
+	a.Etag = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d/%d", a.Generation, a.Metageneration)))
+	fillObjectACL(a)
+}
+
+// touch is Object の metadata を変更した時に Metageneration と更新時刻を進める
+func (o *objectEntry) touch(now time.Time) {
+	o.attrs.Metageneration++
+	o.attrs.Updated = now.UTC().Format(time.RFC3339Nano)
+	o.fillDerivedAttrs()
+}
+
+func (o *objectEntry) clone() *objectEntry {
+	attrs := *o.attrs
+	if o.attrs.Metadata != nil {
+		attrs.Metadata = make(map[string]string, len(o.attrs.Metadata))
+		for k, v := range o.attrs.Metadata {
+			attrs.Metadata[k] = v
+		}
+	}
+	attrs.Acl = cloneObjectACL(o.attrs.Acl)
+	if o.attrs.Owner != nil {
+		owner := *o.attrs.Owner
+		attrs.Owner = &owner
+	}
+	return &objectEntry{
+		attrs: &attrs,
+		blob:  o.blob,
+	}
+}
+
+// immutableObjectFields is Patch で変更できない Object の項目
+var immutableObjectFields = []string{
+	"kind", "id", "selfLink", "mediaLink", "name", "bucket", "generation", "metageneration",
+	"size", "timeCreated", "updated", "timeStorageClassUpdated", "md5Hash", "crc32c", "etag",
+	"retentionExpirationTime",
+}
+
+// mergePatchObject is attrs に JSON Merge Patch を適用した新しい Object を返す
+func mergePatchObject(attrs *apigcs.Object, patch map[string]interface{}) (*apigcs.Object, error) {
+	var updated apigcs.Object
+	if err := mergePatchJSON(attrs, patch, immutableObjectFields, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// mergePatchJSON is current を JSON にしたものに immutable 以外の項目の patch を適用して、結果を updated に入れる
+func mergePatchJSON(current interface{}, patch map[string]interface{}, immutable []string, updated interface{}) error {
+	b, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for _, k := range immutable {
+		delete(patch, k)
+	}
+	merged := mergePatch(m, patch)
+	b, err = json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, updated); err != nil {
+		return errInvalid(err.Error())
+	}
+	return nil
+}
+
+// copyJSON is src を JSON にして dst に読み込むことで deep copy する
+func copyJSON(src interface{}, dst interface{}) error {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// mergePatch is RFC 7396 の JSON Merge Patch を適用する
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(target, k)
+			continue
+		}
+		pm, ok := v.(map[string]interface{})
+		if !ok {
+			target[k] = v
+			continue
+		}
+		tm, _ := target[k].(map[string]interface{})
+		target[k] = mergePatch(tm, pm)
+	}
+	return target
+}
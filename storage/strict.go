@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EnableStrictMode is t.Cleanup で、登録した Response が全て Request されたかを確認するようにする
+// 使われなかった Response があれば、操作ごとにまとめて t.Errorf で報告する
+// AlwaysRespond などで何回でも返すように登録した Response は確認しない
+//
+// NewFakerWithoutTesting などの testing.T が無い Faker では使えないので、VerifyConsumed を使う
+func (faker *Faker) EnableStrictMode() error {
+	t := faker.transport.t
+	if t == nil {
+		return fmt.Errorf("EnableStrictMode requires testing.T. use VerifyConsumed instead")
+	}
+	t.Cleanup(func() {
+		if err := faker.VerifyConsumed(); err != nil {
+			t.Error(err)
+		}
+	})
+	return nil
+}
+
+// VerifyConsumed is 1回だけ返すように登録した Response が全て Request されたかを確認する
+// 使われなかった Response がある場合は、操作ごとにまとめた一覧を error で返す
+func (faker *Faker) VerifyConsumed() error {
+	leftovers := faker.transport.fakeResponses.unconsumed()
+	if len(leftovers) == 0 {
+		return nil
+	}
+
+	// 操作は最初に登録した順に並べる
+	var operations []string
+	groups := make(map[string][]string)
+	for _, r := range leftovers {
+		op := "unknown operation"
+		desc := r.key.String()
+		switch {
+		case r.matcher != nil:
+			op = "matcher"
+			desc = "response registered with RequestMatcher"
+		case r.key.operation != operationUnknown:
+			op = string(r.key.operation)
+		}
+		if _, ok := groups[op]; !ok {
+			operations = append(operations, op)
+		}
+		groups[op] = append(groups[op], desc)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d registered responses were not requested", len(leftovers))
+	for _, op := range operations {
+		fmt.Fprintf(&sb, "\n  %s:", op)
+		for _, desc := range groups[op] {
+			fmt.Fprintf(&sb, "\n    - %s", desc)
+		}
+	}
+	return fmt.Errorf("%s", sb.String())
+}
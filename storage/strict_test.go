@@ -0,0 +1,74 @@
+package storage_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	storagefaker "github.com/sinmetalcraft/gcpfaker/storage"
+)
+
+func TestFaker_EnableStrictMode(t *testing.T) {
+	const bucket = "sinmetal-ci-fake"
+
+	faker := storagefaker.NewFaker(t)
+	if err := faker.EnableStrictMode(); err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AddGetObjectResponse(bucket, "hello.txt", newTextResponse("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AlwaysRespond("https://storage.googleapis.com/"+bucket+"/always.txt", http.MethodGet, &storagefaker.StaticResponse{Body: []byte("always")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// always で登録した Response は使わなくても Cleanup で報告しない
+	if e, g := "Hello", getBody(t, faker.Client, "https://storage.googleapis.com/"+bucket+"/hello.txt"); e != g {
+		t.Errorf("want %q but got %q", e, g)
+	}
+}
+
+func TestFaker_EnableStrictModeWithoutTesting(t *testing.T) {
+	faker := storagefaker.NewFakerWithoutTesting()
+	if err := faker.EnableStrictMode(); err == nil {
+		t.Error("want error but got nil")
+	}
+}
+
+func TestFaker_VerifyConsumed(t *testing.T) {
+	const bucket = "sinmetal-ci-fake"
+
+	faker := storagefaker.NewFakerWithoutTesting()
+	if err := faker.AddGetObjectResponse(bucket, "a.txt", newTextResponse("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AddGetObjectResponse(bucket, "b.txt", newTextResponse("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AddPostObjectOKResponse(bucket, "c.txt", make(map[string][]string), storagefaker.GenerateSimplePostObjectOKResponse(bucket, "c.txt", "text/plain", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := faker.AddResponseWithMatcher(func(req *http.Request) bool { return false }, newTextResponse("matcher")); err != nil {
+		t.Fatal(err)
+	}
+
+	getBody(t, faker.Client, "https://storage.googleapis.com/"+bucket+"/a.txt")
+
+	err := faker.VerifyConsumed()
+	if err == nil {
+		t.Fatal("want error but got nil")
+	}
+	for _, want := range []string{
+		"3 registered responses were not requested",
+		"objects.download:\n    - objects.download bucket=\"sinmetal-ci-fake\" object=\"b.txt\"",
+		"objects.insert:\n    - objects.insert bucket=\"sinmetal-ci-fake\" object=\"c.txt\"",
+		"matcher:\n    - response registered with RequestMatcher",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not contain %q\n%s", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "a.txt") {
+		t.Errorf("consumed response is reported\n%s", err)
+	}
+}
@@ -0,0 +1,128 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/iterator"
+)
+
+func TestStatefulFaker_Versioning(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake-versioning"
+	const object = "backup.txt"
+	if err := stg.Bucket(bucket).Create(ctx, "sinmetal-ci", &storage.BucketAttrs{VersioningEnabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	battrs, err := stg.Bucket(bucket).Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !battrs.VersioningEnabled {
+		t.Errorf("want versioning enabled")
+	}
+
+	first := writeObject(t, stg, bucket, object, "first")
+	second := writeObject(t, stg, bucket, object, "second")
+	obj := stg.Bucket(bucket).Object(object)
+	if err := obj.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := obj.Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("want ErrObjectNotExist but got %v", err)
+	}
+	for _, v := range []struct {
+		attrs *storage.ObjectAttrs
+		want  string
+	}{
+		{first, "first"},
+		{second, "second"},
+	} {
+		r, err := obj.Generation(v.attrs.Generation).NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if e, g := v.want, string(got); e != g {
+			t.Errorf("want body %q but got %q", e, g)
+		}
+		attrs, err := obj.Generation(v.attrs.Generation).Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Deleted.IsZero() {
+			t.Errorf("generation %d is noncurrent but Deleted is zero", v.attrs.Generation)
+		}
+	}
+
+	listGenerations := func(t *testing.T, versions bool) []int64 {
+		t.Helper()
+
+		var got []int64
+		it := stg.Bucket(bucket).Objects(ctx, &storage.Query{Versions: versions})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, attrs.Generation)
+		}
+		return got
+	}
+	if got := listGenerations(t, false); len(got) != 0 {
+		t.Errorf("want no live objects but got %v", got)
+	}
+	if want, got := []int64{first.Generation, second.Generation}, listGenerations(t, true); !cmp.Equal(want, got) {
+		t.Errorf("unexpected generations %s", cmp.Diff(want, got))
+	}
+
+	// Generation を指定した削除は noncurrent を完全に削除する
+	if err := obj.Generation(first.Generation).Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []int64{second.Generation}, listGenerations(t, true); !cmp.Equal(want, got) {
+		t.Errorf("unexpected generations %s", cmp.Diff(want, got))
+	}
+}
+
+func TestStatefulFaker_VersioningEnabledLater(t *testing.T) {
+	ctx := context.Background()
+	_, stg := newStatefulClient(t)
+
+	const bucket = "sinmetal-ci-fake"
+	const object = "overwrite.txt"
+	first := writeObject(t, stg, bucket, object, "first")
+	second := writeObject(t, stg, bucket, object, "second")
+
+	// Versioning を後から有効にすると、それ以降の上書きから古い Generation が残る
+	battrs, err := stg.Bucket(bucket).Update(ctx, storage.BucketAttrsToUpdate{VersioningEnabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !battrs.VersioningEnabled {
+		t.Errorf("want versioning enabled")
+	}
+	writeObject(t, stg, bucket, object, "third")
+
+	obj := stg.Bucket(bucket).Object(object)
+	if _, err := obj.Generation(first.Generation).Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("want ErrObjectNotExist but got %v", err)
+	}
+	if _, err := obj.Generation(second.Generation).Attrs(ctx); err != nil {
+		t.Errorf("noncurrent generation is not found. %v", err)
+	}
+}